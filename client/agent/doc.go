@@ -0,0 +1,3 @@
+// Package agent contains helpers for clients of gpg-agent and other GnuPG
+// components built on top of Assuan protocol.
+package agent
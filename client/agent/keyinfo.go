@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"strconv"
+
+	assuan "github.com/foxcpp/go-assuan/client"
+	"github.com/foxcpp/go-assuan/common"
+)
+
+// KeyInfo is sent (as KEYINFO status) by gpg-agent in response to KEYINFO
+// command.
+//
+// Fields that are not known to agent ("-" in status line) are left empty.
+type KeyInfo struct {
+	Keygrip string
+	// 'D' for regular key stored on disk, 'T' for key on smartcard, 'X'
+	// for unknown type.
+	Type     byte
+	SerialNo string
+	IDStr    string
+	// Whether passphrase for the key is cached.
+	Cached bool
+	// 'P' if key is protected with passphrase, 'C' if it is not protected,
+	// empty if unknown.
+	Protection byte
+	// SSH fingerprint of the key, set only if requested.
+	Fingerprint string
+	// TTL for SSH key, zero if not set.
+	TTL int
+	// Flags as sent by agent (i.e. "D" for disabled SSH key).
+	Flags string
+}
+
+func parseKeyInfo(fields []string) (KeyInfo, error) {
+	// Older versions of gpg-agent don't send fields after protection.
+	if len(fields) < 6 {
+		return KeyInfo{}, errors.New("malformed KEYINFO status: wrong number of fields")
+	}
+	for len(fields) < 9 {
+		fields = append(fields, "-")
+	}
+
+	field := func(i int) string {
+		if fields[i] == "-" {
+			return ""
+		}
+		return fields[i]
+	}
+	info := KeyInfo{
+		Keygrip:     fields[0],
+		SerialNo:    field(2),
+		IDStr:       field(3),
+		Cached:      fields[4] == "1",
+		Fingerprint: field(6),
+		Flags:       field(8),
+	}
+	if t := field(1); t != "" {
+		info.Type = t[0]
+	}
+	if p := field(5); p != "" {
+		info.Protection = p[0]
+	}
+	if ttl := field(7); ttl != "" {
+		var err error
+		info.TTL, err = strconv.Atoi(ttl)
+		if err != nil {
+			return KeyInfo{}, errors.New("malformed KEYINFO status: invalid TTL")
+		}
+	}
+	return info, nil
+}
+
+// IsCached asks gpg-agent whether passphrase for key with specified keygrip
+// is cached.
+//
+// false is returned without error if agent doesn't know the key.
+func IsCached(ses *assuan.Session, keygrip string) (bool, error) {
+	it, err := ses.Stream("KEYINFO", keygrip)
+	if err != nil {
+		return false, err
+	}
+
+	cached := false
+	for {
+		line, err := it.Next()
+		if err == io.EOF {
+			return cached, nil
+		}
+		if err != nil {
+			if perr, ok := err.(common.Error); ok {
+				switch perr.Code {
+				case common.ErrNotFound, common.ErrNoSeckey:
+					return false, nil
+				}
+			}
+			return false, err
+		}
+
+		if line.Type != "S" || line.Keyword != "KEYINFO" {
+			continue
+		}
+		res, err := ParseStatus(line.Keyword, line.Value)
+		if err != nil {
+			it.Close()
+			return false, err
+		}
+		cached = res.(KeyInfo).Cached
+	}
+}
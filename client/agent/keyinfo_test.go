@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	assuan "github.com/foxcpp/go-assuan/client"
+	"github.com/foxcpp/go-assuan/common"
+	"github.com/foxcpp/go-assuan/server"
+)
+
+func TestParseKeyInfo(t *testing.T) {
+	keyword, value, err := common.ParseStatus("KEYINFO 8A56AF2E1A1A7D37DD1C0D3B3A15F6E1AB5E33C0 D - - 1 P - - -")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ParseStatus(keyword, value)
+	if err != nil {
+		t.Fatal("Unexpected ParseStatus error:", err)
+	}
+	expected := KeyInfo{
+		Keygrip:    "8A56AF2E1A1A7D37DD1C0D3B3A15F6E1AB5E33C0",
+		Type:       'D',
+		Cached:     true,
+		Protection: 'P',
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Wrong result: %#v", res)
+	}
+}
+
+func TestIsCached(t *testing.T) {
+	keys := map[string]string{
+		"8A56AF2E1A1A7D37DD1C0D3B3A15F6E1AB5E33C0": "D - - 1 P - - -",
+		"0F3C2DB3AD7E0A6C7D21E8E7A7A1CC0A3E8E6B55": "D - - - P - - -",
+	}
+
+	srvConn, clConn := net.Pipe()
+	go func() {
+		defer srvConn.Close()
+		server.Serve(srvConn, server.ProtoInfo{
+			GetDefaultState: func() interface{} { return nil },
+			Handlers: map[string]server.CommandHandler{
+				"KEYINFO": func(pipe *common.Pipe, _ interface{}, params string) (*common.Error, error) {
+					info, ok := keys[params]
+					if !ok {
+						return common.NewError(common.ErrSrcGPGagent, common.ErrNotFound, "Not found"), nil
+					}
+					return nil, pipe.WriteStatus("KEYINFO", params+" "+info)
+				},
+			},
+		})
+	}()
+	ses, err := assuan.Init(clConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ses.Close()
+
+	for keygrip, expected := range map[string]bool{
+		"8A56AF2E1A1A7D37DD1C0D3B3A15F6E1AB5E33C0": true,
+		"0F3C2DB3AD7E0A6C7D21E8E7A7A1CC0A3E8E6B55": false,
+		"DEADBEEF00000000000000000000000000000000": false,
+	} {
+		cached, err := IsCached(ses, keygrip)
+		if err != nil {
+			t.Fatal("Unexpected IsCached error:", err)
+		}
+		if cached != expected {
+			t.Errorf("Wrong result for %s: %v", keygrip, cached)
+		}
+	}
+}
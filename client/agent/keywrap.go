@@ -0,0 +1,60 @@
+package agent
+
+import (
+	assuan "github.com/foxcpp/go-assuan/client"
+)
+
+// ExportKEK requests key-encryption key used by agent to wrap keys sent
+// in response to EXPORT_KEY.
+//
+// Keys are wrapped using AESWRAP (RFC 3394) algorithm with 128-bit key.
+func ExportKEK(ses *assuan.Session) ([]byte, error) {
+	return ses.SimpleCmd("KEYWRAP_KEY", "--export")
+}
+
+// ImportKEK requests key-encryption key that should be used to wrap keys
+// passed to ImportKey.
+func ImportKEK(ses *assuan.Session) ([]byte, error) {
+	return ses.SimpleCmd("KEYWRAP_KEY", "--import")
+}
+
+// ExportKey exports secret key with specified keygrip from agent.
+//
+// Export KEK is requested before export and returned together with key
+// wrapped using it.
+//
+// Agent may ask for passphrase to unprotect key. Unless loopback pinentry
+// mode is enabled (OPTION pinentry-mode=loopback), it is asked by
+// pinentry and passphrase argument is not used. Otherwise passphrase is
+// sent in response to agent's inquiry, nil passphrase fails export in
+// this case.
+func ExportKey(ses *assuan.Session, keygrip string, passphrase []byte) (kek, wrapped []byte, err error) {
+	kek, err = ExportKEK(ses)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err = ses.Transact("EXPORT_KEY", keygrip, passphraseData(passphrase))
+	if err != nil {
+		return nil, nil, err
+	}
+	return kek, wrapped, nil
+}
+
+// ImportKey imports secret key into agent. Key should be in S-expression
+// format and wrapped using KEK returned by ImportKEK.
+//
+// passphrase is handled in the same way as in ExportKey.
+func ImportKey(ses *assuan.Session, wrapped []byte, passphrase []byte) error {
+	data := passphraseData(passphrase)
+	data["KEYDATA"] = wrapped
+	_, err := ses.Transact("IMPORT_KEY", "", data)
+	return err
+}
+
+func passphraseData(passphrase []byte) map[string]interface{} {
+	data := map[string]interface{}{}
+	if passphrase != nil {
+		data["PASSPHRASE"] = passphrase
+	}
+	return data
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	assuan "github.com/foxcpp/go-assuan/client"
+	"github.com/foxcpp/go-assuan/common"
+	"github.com/foxcpp/go-assuan/server"
+)
+
+func TestExportImportKey(t *testing.T) {
+	const keygrip = "8A56AF2E1A1A7D37DD1C0D3B3A15F6E1AB5E33C0"
+	exportKEK := []byte("export-kek-0123")
+	importKEK := []byte("import-kek-0123")
+	wrappedKey := []byte("wrapped\x00key\n")
+	var imported []byte
+
+	checkPassphrase := func(pipe *common.Pipe) (*common.Error, error) {
+		data, perr, err := server.Inquire(pipe, []string{"PASSPHRASE"})
+		if perr != nil || err != nil {
+			return perr, err
+		}
+		if string(data["PASSPHRASE"]) != "secret" {
+			return common.NewError(common.ErrSrcGPGagent, common.ErrBadPassphrase, "Bad passphrase"), nil
+		}
+		return nil, nil
+	}
+
+	srvConn, clConn := net.Pipe()
+	go func() {
+		defer srvConn.Close()
+		server.Serve(srvConn, server.ProtoInfo{
+			GetDefaultState: func() interface{} { return nil },
+			Handlers: map[string]server.CommandHandler{
+				"KEYWRAP_KEY": func(pipe *common.Pipe, _ interface{}, params string) (*common.Error, error) {
+					switch params {
+					case "--export":
+						return nil, pipe.WriteData(exportKEK)
+					case "--import":
+						return nil, pipe.WriteData(importKEK)
+					}
+					return common.NewError(common.ErrSrcGPGagent, common.ErrAssParameter, "Invalid parameter"), nil
+				},
+				"EXPORT_KEY": func(pipe *common.Pipe, _ interface{}, params string) (*common.Error, error) {
+					if params != keygrip {
+						return common.NewError(common.ErrSrcGPGagent, common.ErrNoSeckey, "No secret key"), nil
+					}
+					if perr, err := checkPassphrase(pipe); perr != nil || err != nil {
+						return perr, err
+					}
+					return nil, pipe.WriteData(wrappedKey)
+				},
+				"IMPORT_KEY": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+					data, perr, err := server.Inquire(pipe, []string{"KEYDATA"})
+					if perr != nil || err != nil {
+						return perr, err
+					}
+					if perr, err := checkPassphrase(pipe); perr != nil || err != nil {
+						return perr, err
+					}
+					imported = data["KEYDATA"]
+					return nil, nil
+				},
+			},
+		})
+	}()
+	ses, err := assuan.Init(clConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ses.Close()
+
+	kek, wrapped, err := ExportKey(ses, keygrip, []byte("secret"))
+	if err != nil {
+		t.Fatal("Unexpected ExportKey error:", err)
+	}
+	if !bytes.Equal(kek, exportKEK) || !bytes.Equal(wrapped, wrappedKey) {
+		t.Errorf("Wrong export result: %q, %q", kek, wrapped)
+	}
+	if _, _, err := ExportKey(ses, keygrip, []byte("wrong")); err == nil {
+		t.Error("ExportKey with wrong passphrase succeeded")
+	}
+
+	kek, err = ImportKEK(ses)
+	if err != nil {
+		t.Fatal("Unexpected ImportKEK error:", err)
+	}
+	if !bytes.Equal(kek, importKEK) {
+		t.Errorf("Wrong import KEK: %q", kek)
+	}
+	if err := ImportKey(ses, wrappedKey, []byte("secret")); err != nil {
+		t.Fatal("Unexpected ImportKey error:", err)
+	}
+	if !bytes.Equal(imported, wrappedKey) {
+		t.Errorf("Wrong key data imported: %q", imported)
+	}
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SigCreated is sent (as SIG_CREATED status) after signature is created.
+type SigCreated struct {
+	// Signature type: 'D' for detached, 'C' for cleartext and 'S' for
+	// standard signature.
+	Type byte
+	// OpenPGP public key algorithm ID.
+	PubKeyAlgo int
+	// OpenPGP hash algorithm ID.
+	HashAlgo int
+	// OpenPGP signature class.
+	Class   byte
+	Created time.Time
+	// Fingerprint of the key used to create signature.
+	Fingerprint string
+}
+
+// SigID is sent (as SIG_ID status) to provide unique identifier of the
+// signature.
+type SigID struct {
+	ID      string
+	Created time.Time
+}
+
+// NewSig is sent (as NEWSIG status) before each signature is processed.
+type NewSig struct {
+	// Signer's user ID, if known.
+	SignerUID string
+}
+
+// ParseStatus converts status line (keyword and value as returned by
+// common.ParseStatus) into one of SigCreated, SigID, NewSig or KeyInfo.
+//
+// nil is returned without error for keywords unknown to this package.
+func ParseStatus(keyword, value string) (interface{}, error) {
+	fields := strings.Fields(value)
+	switch keyword {
+	case "SIG_CREATED":
+		return parseSigCreated(fields)
+	case "SIG_ID":
+		return parseSigID(fields)
+	case "NEWSIG":
+		return NewSig{SignerUID: value}, nil
+	case "KEYINFO":
+		return parseKeyInfo(fields)
+	}
+	return nil, nil
+}
+
+func parseSigCreated(fields []string) (SigCreated, error) {
+	if len(fields) != 6 {
+		return SigCreated{}, errors.New("malformed SIG_CREATED status: wrong number of fields")
+	}
+	if len(fields[0]) != 1 {
+		return SigCreated{}, errors.New("malformed SIG_CREATED status: invalid signature type")
+	}
+
+	pkAlgo, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return SigCreated{}, fmt.Errorf("malformed SIG_CREATED status: invalid public key algorithm: %w", err)
+	}
+	hashAlgo, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return SigCreated{}, fmt.Errorf("malformed SIG_CREATED status: invalid hash algorithm: %w", err)
+	}
+	class, err := strconv.ParseUint(fields[3], 16, 8)
+	if err != nil {
+		return SigCreated{}, fmt.Errorf("malformed SIG_CREATED status: invalid signature class: %w", err)
+	}
+	created, err := parseTimestamp(fields[4])
+	if err != nil {
+		return SigCreated{}, fmt.Errorf("malformed SIG_CREATED status: %w", err)
+	}
+
+	return SigCreated{
+		Type:        fields[0][0],
+		PubKeyAlgo:  pkAlgo,
+		HashAlgo:    hashAlgo,
+		Class:       byte(class),
+		Created:     created,
+		Fingerprint: fields[5],
+	}, nil
+}
+
+func parseSigID(fields []string) (SigID, error) {
+	if len(fields) != 3 {
+		return SigID{}, errors.New("malformed SIG_ID status: wrong number of fields")
+	}
+
+	// Second field is creation date (YYYY-MM-DD) which is redundant
+	// since we have full timestamp.
+	created, err := parseTimestamp(fields[2])
+	if err != nil {
+		return SigID{}, fmt.Errorf("malformed SIG_ID status: %w", err)
+	}
+	return SigID{ID: fields[0], Created: created}, nil
+}
+
+// parseTimestamp parses timestamp in one of formats used by GnuPG: seconds
+// since epoch or ISO 8601 basic format (YYYYMMDDTHHMMSS), always in UTC.
+func parseTimestamp(s string) (time.Time, error) {
+	if strings.ContainsRune(s, 'T') {
+		t, err := time.Parse("20060102T150405", s)
+		if err != nil {
+			return time.Time{}, errors.New("invalid timestamp")
+		}
+		return t, nil
+	}
+
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("invalid timestamp")
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
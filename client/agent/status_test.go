@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-assuan/common"
+)
+
+func TestParseStatus(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected interface{}
+	}{
+		{
+			"NEWSIG foxcpp@example.org",
+			NewSig{SignerUID: "foxcpp@example.org"},
+		},
+		{
+			"NEWSIG",
+			NewSig{},
+		},
+		{
+			"SIG_CREATED S 1 8 00 1548940513 2499BEB8B47B0235009A5F0AEE8384B0561A25AF",
+			SigCreated{
+				Type:        'S',
+				PubKeyAlgo:  1,
+				HashAlgo:    8,
+				Class:       0x00,
+				Created:     time.Unix(1548940513, 0).UTC(),
+				Fingerprint: "2499BEB8B47B0235009A5F0AEE8384B0561A25AF",
+			},
+		},
+		{
+			"SIG_CREATED D 22 10 01 20190131T131513 2499BEB8B47B0235009A5F0AEE8384B0561A25AF",
+			SigCreated{
+				Type:        'D',
+				PubKeyAlgo:  22,
+				HashAlgo:    10,
+				Class:       0x01,
+				Created:     time.Date(2019, 1, 31, 13, 15, 13, 0, time.UTC),
+				Fingerprint: "2499BEB8B47B0235009A5F0AEE8384B0561A25AF",
+			},
+		},
+		{
+			"SIG_ID 3xGV0cDQ1gR2pGZqH2+XWYhNSuk 2019-01-31 1548940513",
+			SigID{ID: "3xGV0cDQ1gR2pGZqH2+XWYhNSuk", Created: time.Unix(1548940513, 0).UTC()},
+		},
+		{
+			"PROGRESS need_entropy X 30 120",
+			nil,
+		},
+	}
+
+	for _, c := range cases {
+		keyword, value, err := common.ParseStatus(c.line)
+		if err != nil {
+			t.Fatal("Unexpected common.ParseStatus error:", err)
+		}
+		res, err := ParseStatus(keyword, value)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", c.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, c.expected) {
+			t.Errorf("Wrong result for %q: %#v", c.line, res)
+		}
+	}
+
+	for _, line := range []string{
+		"SIG_CREATED S 1 8 00 1548940513",
+		"SIG_CREATED S 1 8 ZZ 1548940513 2499BEB8B47B0235009A5F0AEE8384B0561A25AF",
+		"SIG_ID 3xGV0cDQ1gR2pGZqH2+XWYhNSuk 2019-01-31 yesterday",
+	} {
+		keyword, value, _ := common.ParseStatus(line)
+		if _, err := ParseStatus(keyword, value); err == nil {
+			t.Errorf("No error for malformed status %q", line)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"strings"
+
+	"github.com/foxcpp/go-assuan/common"
+)
+
+// Greeting returns text sent by server together with the first OK (i.e.
+// "Pleased to meet you, process 1234"). It is empty for sessions created
+// using InitNoGreeting.
+func (ses *Session) Greeting() string {
+	return ses.greeting
+}
+
+// GetInfo sends GETINFO with specified subcommand and returns data sent
+// in response.
+func (ses *Session) GetInfo(what string) ([]byte, error) {
+	return ses.SimpleCmd("GETINFO", what)
+}
+
+// CapabilityProbes describes checks done by Session.Capabilities. Each
+// check results in single entry in returned map, keys are prefixed with
+// type of the check.
+type CapabilityProbes struct {
+	// Substrings looked up in server's greeting (case-insensitive), keys
+	// are "greeting:" + substring.
+	Greeting []string
+	// Commands checked using Session.Supports, keys are "cmd:" + command.
+	Commands []string
+	// GETINFO subcommands, capability is present if server responds with
+	// OK. Keys are "getinfo:" + subcommand.
+	Info []string
+}
+
+// DefaultCapabilityProbes contains checks for commands and GETINFO
+// subcommands implemented by GnuPG components.
+var DefaultCapabilityProbes = CapabilityProbes{
+	Greeting: []string{"process"},
+	Commands: []string{"GETINFO", "OPTION", "CANCEL", "AUTH"},
+	Info:     []string{"version", "pid", "socket_name", "ssh_socket_name", "restricted"},
+}
+
+// Capabilities runs checks described by probes and returns their results.
+// Each check is done using separate command (except greeting ones), so
+// this should be done once after connecting.
+//
+// Error sent by server is treated as absence of capability, I/O errors
+// are returned as is.
+func (ses *Session) Capabilities(probes CapabilityProbes) (map[string]bool, error) {
+	caps := make(map[string]bool, len(probes.Greeting)+len(probes.Commands)+len(probes.Info))
+
+	greeting := strings.ToLower(ses.Greeting())
+	for _, substr := range probes.Greeting {
+		caps["greeting:"+substr] = strings.Contains(greeting, strings.ToLower(substr))
+	}
+
+	for _, cmd := range probes.Commands {
+		ok, err := ses.Supports(cmd)
+		if err != nil {
+			if _, perr := err.(common.Error); !perr {
+				return nil, err
+			}
+		}
+		caps["cmd:"+cmd] = ok
+	}
+
+	for _, what := range probes.Info {
+		_, err := ses.GetInfo(what)
+		if err != nil {
+			if _, perr := err.(common.Error); !perr {
+				return nil, err
+			}
+		}
+		caps["getinfo:"+what] = err == nil
+	}
+	return caps, nil
+}
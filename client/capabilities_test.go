@@ -0,0 +1,59 @@
+package client_test
+
+import (
+	"reflect"
+	"testing"
+
+	assuan "github.com/foxcpp/go-assuan/client"
+	"github.com/foxcpp/go-assuan/common"
+	"github.com/foxcpp/go-assuan/server"
+)
+
+func TestSession_Capabilities(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{
+		Greeting: "Pleased to meet you, process 42",
+		Handlers: map[string]server.CommandHandler{
+			"GETINFO": func(pipe *common.Pipe, _ interface{}, params string) (*common.Error, error) {
+				if params == "version" {
+					return nil, pipe.WriteData([]byte("2.2.40"))
+				}
+				return common.NewAssuanError(common.ErrAssParameter, "unknown value for WHAT"), nil
+			},
+		},
+		Help: map[string][]string{
+			"GETINFO": {"GETINFO <what>"},
+		},
+	})
+	defer ses.Close()
+
+	if ses.Greeting() != "Pleased to meet you, process 42" {
+		t.Errorf("Wrong greeting: %q", ses.Greeting())
+	}
+	version, err := ses.GetInfo("version")
+	if err != nil {
+		t.Fatal("Unexpected GetInfo error:", err)
+	}
+	if string(version) != "2.2.40" {
+		t.Errorf("Wrong version: %q", version)
+	}
+
+	caps, err := ses.Capabilities(assuan.CapabilityProbes{
+		Greeting: []string{"Process", "gpg-agent"},
+		Commands: []string{"GETINFO", "PKSIGN"},
+		Info:     []string{"version", "pid"},
+	})
+	if err != nil {
+		t.Fatal("Unexpected Capabilities error:", err)
+	}
+	expected := map[string]bool{
+		"greeting:Process":   true,
+		"greeting:gpg-agent": false,
+		"cmd:GETINFO":        true,
+		"cmd:PKSIGN":         false,
+		"getinfo:version":    true,
+		"getinfo:pid":        false,
+	}
+	if !reflect.DeepEqual(caps, expected) {
+		t.Errorf("Wrong capabilities: %v", caps)
+	}
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned by Pool.Get after pool is closed.
+var ErrPoolClosed = errors.New("pool is closed")
+
+// Pool maintains a set of idle sessions to the same server that can be
+// reused to avoid costs of connection establishment.
+//
+// Pool is safe for concurrent use. Fields should not be changed after the
+// first use.
+type Pool struct {
+	// Dial is called to create new session when there are no idle ones,
+	// i.e. func() (*Session, error) { return DialContext(ctx, "unix", path) }.
+	Dial func() (*Session, error)
+	// Maximum number of idle sessions kept by pool, sessions returned by
+	// Put when there are already MaxIdle idle ones are closed. Zero means
+	// 2.
+	MaxIdle int
+	// Idle sessions that were not used for this time are closed instead of
+	// being reused. Zero means no limit.
+	IdleTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   []pooledSession
+	closed bool
+}
+
+type pooledSession struct {
+	ses      *Session
+	lastUsed time.Time
+}
+
+// Get returns idle session or creates new one using Dial.
+//
+// Idle session is checked using NOP before it is returned, sessions that
+// fail the check are closed and next one is tried.
+func (p *Pool) Get() (*Session, error) {
+	for {
+		ses, expired, err := p.popIdle()
+		for _, s := range expired {
+			Logger.Println("Pooled session idle timeout expired, closing")
+			s.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ses == nil {
+			break
+		}
+
+		if _, err := ses.SimpleCmd("NOP", ""); err != nil {
+			Logger.Println("Pooled session is dead, closing:", err)
+			ses.Close()
+			continue
+		}
+		return ses, nil
+	}
+
+	Logger.Println("No idle sessions in pool, dialing...")
+	return p.Dial()
+}
+
+// popIdle removes most recently used idle session from pool, nil is
+// returned if there are no idle sessions. Sessions with expired idle
+// timeout are removed too and returned in expired, caller should close
+// them.
+func (p *Pool) popIdle() (ses *Session, expired []*Session, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, nil, ErrPoolClosed
+	}
+	for len(p.idle) != 0 {
+		last := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+
+		if p.IdleTimeout != 0 && time.Since(last.lastUsed) > p.IdleTimeout {
+			expired = append(expired, last.ses)
+			continue
+		}
+		return last.ses, expired, nil
+	}
+	return nil, expired, nil
+}
+
+// Put returns session to pool for reuse.
+//
+// Session should be in consistent state, i.e. sessions on which I/O errors
+// occurred should be closed instead. Options set on session are not reset.
+func (p *Pool) Put(ses *Session) {
+	if !p.putIdle(ses) {
+		Logger.Println("Pool is full, closing session")
+		ses.Close()
+	}
+}
+
+func (p *Pool) putIdle(ses *Session) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	maxIdle := p.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = 2
+	}
+	if p.closed || len(p.idle) >= maxIdle {
+		return false
+	}
+
+	p.idle = append(p.idle, pooledSession{ses: ses, lastUsed: time.Now()})
+	return true
+}
+
+// Close closes all idle sessions. Sessions returned by Put after Close are
+// closed immediately.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	var err error
+	for _, s := range idle {
+		if cerr := s.ses.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
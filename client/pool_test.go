@@ -0,0 +1,117 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	assuan "github.com/foxcpp/go-assuan/client"
+	"github.com/foxcpp/go-assuan/common"
+	"github.com/foxcpp/go-assuan/server"
+)
+
+func TestPool(t *testing.T) {
+	l := serveTestProto(t, server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"DROP": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return nil, errors.New("dropping connection")
+			},
+		},
+		GetDefaultState: func() interface{} { return nil },
+	})
+	defer l.Close()
+
+	newPool := func(dials *int) *assuan.Pool {
+		return &assuan.Pool{
+			Dial: func() (*assuan.Session, error) {
+				*dials++
+				return assuan.DialContext(context.Background(), "tcp", l.Addr().String())
+			},
+		}
+	}
+	get := func(t *testing.T, p *assuan.Pool) *assuan.Session {
+		ses, err := p.Get()
+		if err != nil {
+			t.Fatal("Unexpected Get error:", err)
+		}
+		return ses
+	}
+
+	t.Run("reuse", func(t *testing.T) {
+		dials := 0
+		p := newPool(&dials)
+		defer p.Close()
+
+		first := get(t, p)
+		p.Put(first)
+		if second := get(t, p); second != first {
+			t.Error("Idle session is not reused")
+		}
+		if dials != 1 {
+			t.Errorf("Expected 1 dial, got %d", dials)
+		}
+	})
+	t.Run("dead session", func(t *testing.T) {
+		dials := 0
+		p := newPool(&dials)
+		defer p.Close()
+
+		first := get(t, p)
+		if _, err := first.SimpleCmd("DROP", ""); err == nil {
+			t.Fatal("Connection is not dropped")
+		}
+		p.Put(first)
+		if second := get(t, p); second == first {
+			t.Error("Dead session is reused")
+		}
+		if dials != 2 {
+			t.Errorf("Expected 2 dials, got %d", dials)
+		}
+	})
+	t.Run("idle timeout", func(t *testing.T) {
+		dials := 0
+		p := newPool(&dials)
+		p.IdleTimeout = 10 * time.Millisecond
+		defer p.Close()
+
+		first := get(t, p)
+		p.Put(first)
+		time.Sleep(20 * time.Millisecond)
+		if second := get(t, p); second == first {
+			t.Error("Expired session is reused")
+		}
+		if dials != 2 {
+			t.Errorf("Expected 2 dials, got %d", dials)
+		}
+	})
+	t.Run("max idle", func(t *testing.T) {
+		dials := 0
+		p := newPool(&dials)
+		p.MaxIdle = 1
+		defer p.Close()
+
+		first, second := get(t, p), get(t, p)
+		p.Put(first)
+		p.Put(second)
+		if _, err := second.SimpleCmd("NOP", ""); err == nil {
+			t.Error("Session over MaxIdle is not closed")
+		}
+		if ses := get(t, p); ses != first {
+			t.Error("Idle session is not reused")
+		}
+	})
+	t.Run("closed", func(t *testing.T) {
+		dials := 0
+		p := newPool(&dials)
+
+		ses := get(t, p)
+		p.Put(ses)
+		if err := p.Close(); err != nil {
+			t.Error("Unexpected Close error:", err)
+		}
+		if _, err := p.Get(); err != assuan.ErrPoolClosed {
+			t.Error("Expected ErrPoolClosed, got:", err)
+		}
+	})
+}
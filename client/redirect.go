@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Maximum size of socket redirect file we are willing to read.
+const maxSocketFileSize = 4096
+
+// Length of nonce written to socket file by libassuan's socket emulation.
+const socketNonceLen = 16
+
+var redirectMagic = []byte("%Assuan%\n")
+
+// DialAgent connects to Assuan server (i.e. gpg-agent) listening on Unix
+// socket at path and initiates session.
+//
+// If path is a regular file instead of a socket, it is interpreted as
+// written by libassuan:
+//
+//   - Redirect file starting with "%Assuan%" line followed by
+//     "socket=/path/to/real/socket" line (${VAR} references are expanded
+//     using environment), used when real socket path is too long or when
+//     socket can't be created at this location. Redirect is followed only
+//     once.
+//   - Socket emulation file containing TCP port number on first line
+//     followed by 16-byte nonce, used on systems without AF_UNIX (Windows).
+//     Connection is made to this port on localhost and nonce is sent
+//     before anything else.
+//
+// ctx is used in the same way as in DialContext.
+func DialAgent(ctx context.Context, path string) (*Session, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return DialContext(ctx, "unix", path)
+	}
+
+	Logger.Println("Socket", path, "is a regular file, reading redirect...")
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	contents, err := io.ReadAll(io.LimitReader(f, maxSocketFileSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(contents, redirectMagic) {
+		target, err := parseRedirect(contents[len(redirectMagic):])
+		if err != nil {
+			return nil, err
+		}
+		Logger.Println("... redirected to", target)
+		return DialContext(ctx, "unix", target)
+	}
+
+	port, nonce, err := parseSocketEmulation(contents)
+	if err != nil {
+		return nil, err
+	}
+	Logger.Println("... emulated socket on port", port)
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		Logger.Println("... dial error:", err)
+		return nil, err
+	}
+	return initConn(ctx, conn, nonce)
+}
+
+// parseRedirect extracts socket path from redirect file contents (without
+// "%Assuan%" line).
+func parseRedirect(contents []byte) (string, error) {
+	for _, line := range bytes.Split(contents, []byte{'\n'}) {
+		if !bytes.HasPrefix(line, []byte("socket=")) {
+			continue
+		}
+		target := os.Expand(string(line[len("socket="):]), os.Getenv)
+		if target == "" {
+			return "", errors.New("malformed socket redirect: empty socket path")
+		}
+		return target, nil
+	}
+	return "", errors.New("malformed socket redirect: no socket path")
+}
+
+// parseSocketEmulation extracts TCP port and nonce from socket emulation
+// file contents.
+func parseSocketEmulation(contents []byte) (int, []byte, error) {
+	i := bytes.IndexByte(contents, '\n')
+	if i == -1 {
+		return 0, nil, errors.New("malformed socket file: no port")
+	}
+	port, err := strconv.Atoi(string(bytes.TrimSuffix(contents[:i], []byte{'\r'})))
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, nil, errors.New("malformed socket file: invalid port")
+	}
+	nonce := contents[i+1:]
+	if len(nonce) != socketNonceLen {
+		return 0, nil, errors.New("malformed socket file: invalid nonce length")
+	}
+	return port, nonce, nil
+}
@@ -0,0 +1,100 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assuan "github.com/foxcpp/go-assuan/client"
+	"github.com/foxcpp/go-assuan/server"
+)
+
+func TestDialAgent(t *testing.T) {
+	proto := server.ProtoInfo{
+		GetDefaultState: func() interface{} { return nil },
+	}
+	dir, err := ioutil.TempDir("", "go-assuan-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile := func(t *testing.T, contents []byte) string {
+		path := filepath.Join(dir, "S.gpg-agent")
+		if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	checkSession := func(t *testing.T, path string) {
+		ses, err := assuan.DialAgent(context.Background(), path)
+		if err != nil {
+			t.Fatal("Unexpected DialAgent error:", err)
+		}
+		defer ses.Close()
+		if _, err := ses.SimpleCmd("NOP", ""); err != nil {
+			t.Error("Unexpected NOP error:", err)
+		}
+	}
+
+	realPath := filepath.Join(dir, "real.sock")
+	l, err := net.Listen("unix", realPath)
+	if err != nil {
+		t.Skip("Failed to create listener:", err)
+	}
+	defer l.Close()
+	go server.ServeNet(l, proto)
+
+	t.Run("socket", func(t *testing.T) {
+		checkSession(t, realPath)
+	})
+	t.Run("redirect", func(t *testing.T) {
+		os.Setenv("GO_ASSUAN_TEST_DIR", dir)
+		defer os.Unsetenv("GO_ASSUAN_TEST_DIR")
+		checkSession(t, writeFile(t, []byte("%Assuan%\nsocket=${GO_ASSUAN_TEST_DIR}/real.sock\n")))
+	})
+	t.Run("redirect without socket", func(t *testing.T) {
+		path := writeFile(t, []byte("%Assuan%\nfoo=bar\n"))
+		if _, err := assuan.DialAgent(context.Background(), path); err == nil {
+			t.Error("Expected error for redirect without socket path")
+		}
+	})
+	t.Run("socket emulation", func(t *testing.T) {
+		nonce := []byte("0123456789ABCDEF")
+		tl, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skip("Failed to create listener:", err)
+		}
+		defer tl.Close()
+		go func() {
+			conn, err := tl.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			got := make([]byte, len(nonce))
+			if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, nonce) {
+				t.Errorf("Nonce mismatch: %q", got)
+				return
+			}
+			server.Serve(conn, proto)
+		}()
+
+		port := tl.Addr().(*net.TCPAddr).Port
+		checkSession(t, writeFile(t, append([]byte(fmt.Sprintf("%d\n", port)), nonce...)))
+	})
+	t.Run("malformed", func(t *testing.T) {
+		for _, contents := range []string{"", "not a port\n0123456789ABCDEF", "1234\nshort"} {
+			path := writeFile(t, []byte(contents))
+			if _, err := assuan.DialAgent(context.Background(), path); err == nil {
+				t.Errorf("Expected error for %q", contents)
+			}
+		}
+	})
+}
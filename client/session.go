@@ -1,10 +1,18 @@
 package client
 
 import (
+	"context"
 	"encoding"
 	"errors"
+	"fmt"
 	"io"
+	"net"
+	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/foxcpp/go-assuan/common"
 )
@@ -16,22 +24,256 @@ import (
 // reason there is no generic Session object that will work for both client and
 // server. In particular, client.Session (the struct you are looking at)
 // represents client side of connection.
+//
+// Session is safe for concurrent use, commands sent by different goroutines
+// are serialized.
 type Session struct {
+	// Pipe is an underlying command stream.
+	//
+	// Using it directly together with Session methods is dangerous:
+	// command sent using Pipe.WriteLine while another goroutine waits for
+	// response in SimpleCmd or response left unread will desynchronize
+	// the stream. Use WithRawPipe instead.
 	Pipe common.Pipe
+
+	// ReturnPartialOnError controls whether data received before ERR
+	// is returned by SimpleCmd and Transact together with error.
+	// By default it is discarded.
+	ReturnPartialOnError bool
+
+	// Strict enables detection of unexpected data sent by server after
+	// OK or ERR. If such data is present then ErrTrailingData is returned
+	// instead of command result.
+	//
+	// Only data that already arrived together with the response is
+	// detected, this is intended to help with diagnosing buggy servers and
+	// not as a reliable protocol check.
+	//
+	// Strict mode also enables detection of API misuse. Session is always
+	// in one of the following states:
+	//
+	//	idle: no operation is in progress.
+	//	awaiting response: command is sent (SimpleCmd, Transact, Stream,
+	//	  etc) or raw pipe is used (WriteRaw, WithRawPipe), session is
+	//	  locked until operation is complete or LineIter is closed.
+	//	inquiry: Transact is sending data in response to INQUIRE. Only
+	//	  Cancel is allowed in this state.
+	//
+	// Normally methods called in states other than idle wait until
+	// session is idle, which deadlocks if they are called from callbacks,
+	// from io.Reader passed to Transact or while LineIter is not drained
+	// in the same goroutine. In strict mode they fail with ErrWrongState
+	// instead. Cancel fails with ErrNoInquiry in states other than
+	// inquiry regardless of strict mode.
+	//
+	// Since ErrWrongState is returned instead of waiting, strict mode
+	// should not be used if session is shared by several goroutines.
+	Strict bool
+
+	// MaxResponseSize limits amount of data accepted in response to single
+	// SimpleCmd or Transact call, in bytes. If server sends more, the rest
+	// of response is read and discarded and ErrResponseTooLarge is
+	// returned. Zero means no limit.
+	MaxResponseSize int
+
+	// Held while command is in progress.
+	mu sync.Mutex
+
+	lastErrLck sync.Mutex
+	lastErr    *common.Error
+
+	// Amount of response data buffered by command in progress and maximum
+	// of it over session lifetime.
+	bufLck       sync.Mutex
+	buffered     int
+	peakBuffered int
+
+	// Protected by mu.
+	commentCb func(text string)
+	statusCb  func(keyword, value string)
+	lineCb    func(line RawLine)
+
+	// Used by Cancel to abort answering to inquiry.
+	cancelLck sync.Mutex
+	inquiring bool
+	cancelled bool
+
+	// Set while session is used by some operation, protected by cancelLck.
+	busy bool
+	// Set by Close, protected by cancelLck.
+	closed bool
+
+	// Text sent by server together with the first OK.
+	greeting string
+
+	// Set only for sessions created using DialContext.
+	conn net.Conn
+	done chan struct{}
 }
 
+// ErrProtocol is returned if server sent line that is not expected at
+// this point, it is wrapped together with offending line.
+var ErrProtocol = errors.New("protocol error")
+
+func unexpectedLine(cmd, params string) error {
+	Logger.Println("... unexpected line:", cmd, params)
+	if params == "" {
+		return fmt.Errorf("%w: unexpected line from server: %s", ErrProtocol, cmd)
+	}
+	return fmt.Errorf("%w: unexpected line from server: %s %s", ErrProtocol, cmd, params)
+}
+
+// ErrResponseTooLarge is returned if server sent more data than allowed by
+// Session.MaxResponseSize.
+var ErrResponseTooLarge = errors.New("too much data in response")
+
+// ErrSessionClosed is returned by Session methods called after Close.
+var ErrSessionClosed = errors.New("session is closed")
+
+// ErrWrongState is returned in strict mode if Session method is called
+// when session state doesn't allow it, see Session.Strict.
+var ErrWrongState = errors.New("operation is not allowed in current session state")
+
+// ErrTrailingData is returned in strict mode if server sent something after
+// completing response to command.
+var ErrTrailingData = errors.New("unexpected data after end of response")
+
 // Init initiates session using passed Reader/Writer.
 func Init(stream io.ReadWriter) (*Session, error) {
+	pipe := common.New(stream)
+	return NewSession(&pipe)
+}
+
+// NewSession initiates session using already configured pipe, i.e. with
+// non-default DataChunkSize or line length restrictions.
+//
+// Session takes over the pipe, it should not be used directly after call.
+func NewSession(pipe *common.Pipe) (*Session, error) {
 	Logger.Println("Starting session...")
-	ses := &Session{common.New(stream)}
+	ses := &Session{Pipe: *pipe}
 
 	// Take server's OK from pipe.
-	_, _, err := ses.Pipe.ReadLine()
+	_, greeting, err := ses.Pipe.ReadLine()
 	if err != nil {
 		Logger.Println("... I/O error:", err)
 		return nil, err
 	}
+	ses.greeting = greeting
+
+	return ses, nil
+}
+
+// InitNoGreeting initiates session using passed Reader/Writer without
+// waiting for server's greeting. Useful only with servers that don't send
+// it (see server.ProtoInfo.SuppressGreeting).
+func InitNoGreeting(stream io.ReadWriter) *Session {
+	Logger.Println("Starting session without greeting...")
+	return &Session{Pipe: common.New(stream)}
+}
+
+// ErrGreetingTimeout is returned by InitTimeout if server didn't send
+// greeting in time.
+var ErrGreetingTimeout = errors.New("timed out waiting for server greeting")
+
+// InitTimeout is same as Init but fails with ErrGreetingTimeout if greeting
+// is not received within timeout.
+//
+// If stream doesn't support read deadlines (net.Conn does) then greeting
+// is read in separate goroutine which stays blocked after timeout until
+// stream is closed, so caller should close it in this case.
+func InitTimeout(stream io.ReadWriter, timeout time.Duration) (*Session, error) {
+	if conn, ok := stream.(interface{ SetReadDeadline(time.Time) error }); ok {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		ses, err := Init(stream)
+		if err != nil {
+			if terr, ok := err.(interface{ Timeout() bool }); ok && terr.Timeout() {
+				return nil, ErrGreetingTimeout
+			}
+			return nil, err
+		}
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			return nil, err
+		}
+		return ses, nil
+	}
+
+	type result struct {
+		ses *Session
+		err error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		ses, err := Init(stream)
+		resCh <- result{ses, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-resCh:
+		return res.ses, res.err
+	case <-timer.C:
+		Logger.Println("... timed out waiting for greeting")
+		return nil, ErrGreetingTimeout
+	}
+}
+
+// DialContext connects to the address on the named network (see net.Dial)
+// and initiates session using established connection.
+//
+// ctx governs the whole lifetime of the session, not only dialing: its
+// deadline (if any) is applied to all I/O on the connection and the
+// connection is closed when ctx is cancelled.
+func DialContext(ctx context.Context, network, addr string) (*Session, error) {
+	Logger.Println("Connecting to", network, addr+"...")
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		Logger.Println("... dial error:", err)
+		return nil, err
+	}
+	return initConn(ctx, conn, nil)
+}
+
+// initConn initiates session using established connection, nonce (if
+// not nil) is sent to server before waiting for greeting. See DialContext
+// for how ctx is used.
+func initConn(ctx context.Context, conn net.Conn, nonce []byte) (*Session, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			Logger.Println("Context is done, closing connection:", ctx.Err())
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if nonce != nil {
+		if _, err := conn.Write(nonce); err != nil {
+			close(done)
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	ses, err := Init(conn)
+	if err != nil {
+		close(done)
+		conn.Close()
+		return nil, err
+	}
+	ses.conn = conn
+	ses.done = done
 	return ses, nil
 }
 
@@ -64,13 +306,40 @@ func InitCmd(cmd *exec.Cmd) (*Session, error) {
 }
 
 // Close sends BYE and closes underlying pipe.
+//
+// Connection is closed too if session was created using DialContext.
+// Subsequent calls to Close do nothing and return nil, other methods
+// return ErrSessionClosed.
 func (ses *Session) Close() error {
+	if err := ses.lock(); err != nil {
+		if err == ErrSessionClosed {
+			return nil
+		}
+		return err
+	}
+	defer ses.unlock()
+
+	ses.cancelLck.Lock()
+	ses.closed = true
+	ses.cancelLck.Unlock()
+
 	Logger.Println("Closing session (sending BYE)...")
-	if err := ses.Pipe.WriteLine("BYE", ""); err != nil {
+	err := ses.Pipe.WriteLine("BYE", "")
+	if err != nil {
 		Logger.Println("... I/O error:", err)
-		return err
 	}
 	// Server should respond with "OK" , but we don't care.
+
+	if ses.conn != nil {
+		close(ses.done)
+		if cerr := ses.conn.Close(); err == nil {
+			err = cerr
+		}
+		ses.conn = nil
+	}
+	if err != nil {
+		return err
+	}
 	return ses.Pipe.Close()
 }
 
@@ -84,106 +353,752 @@ func (ses *Session) Reset() error {
 	return err
 }
 
+// StatusLine is a status (S) line received from server.
+type StatusLine struct {
+	Keyword string
+	// Unescaped value.
+	Value string
+}
+
+// Result is a complete response of server to command.
+type Result struct {
+	// Data sent by server in D lines, concatenated.
+	Data []byte
+	// Status lines in the same order as they were received.
+	Status []StatusLine
+	// Text sent by server together with final OK, usually empty.
+	OK string
+}
+
 // SimpleCmd sends command with specified parameters and reads data sent by server if any.
+//
+// It is same as Exec but returns only data.
 func (ses *Session) SimpleCmd(cmd string, params string) (data []byte, err error) {
+	res, err := ses.Exec(cmd, params)
+	return res.Data, err
+}
+
+// Exec sends command with specified parameters and reads complete
+// response of server.
+//
+// If server responded with ERR, Result contains data and status lines
+// received before error only if ReturnPartialOnError is set.
+//
+// If data or status line sent by server is longer than line length limit,
+// it is skipped and *common.LineTooLongError is returned after the rest
+// of response is read, so session stays usable.
+func (ses *Session) Exec(cmd string, params string) (Result, error) {
+	if err := ses.lock(); err != nil {
+		return Result{}, err
+	}
+	defer ses.unlock()
+	return ses.exec(cmd, params)
+}
+
+func (ses *Session) simpleCmd(cmd string, params string) (data []byte, err error) {
+	res, err := ses.exec(cmd, params)
+	return res.Data, err
+}
+
+func (ses *Session) exec(cmd string, params string) (Result, error) {
 	Logger.Println("Sending command:", cmd, params)
-	err = ses.Pipe.WriteLine(cmd, params)
+	err := ses.Pipe.WriteLine(cmd, params)
 	if err != nil {
 		Logger.Println("... I/O error:", err)
-		return []byte{}, err
+		return Result{}, err
 	}
+	defer ses.releaseBuffered()
 
+	var (
+		res Result
+		dec dataDecoder
+	)
+	// Set if server sent INQUIRE, we cancel it but still need to read
+	// rest of response. Same for ErrResponseTooLarge.
+	var protoErr error
 	for {
-		scmd, sparams, err := ses.Pipe.ReadLine()
+		scmd, sparams, err := ses.readLineOrStatus()
 		if err != nil {
-			Logger.Println("... I/O error:", err)
-			return []byte{}, err
+			lerr, err := ses.skipLongLine(err)
+			if err != nil {
+				Logger.Println("... I/O error:", err)
+				return Result{}, err
+			}
+			if protoErr == nil {
+				protoErr = lerr
+			}
+			continue
 		}
 
-		if scmd == "OK" {
-			return data, nil
-		}
-		if scmd == "ERR" {
+		switch scmd {
+		case "OK":
+			ses.setLastError(nil)
+			if err := ses.checkTrailing(); err != nil {
+				return Result{}, err
+			}
+			if protoErr != nil {
+				return Result{}, protoErr
+			}
+			if err := dec.finish(); err != nil {
+				return Result{}, err
+			}
+			res.OK = sparams
+			return res, nil
+		case "ERR":
 			Logger.Println("... Received ERR: ", sparams)
-			return []byte{}, common.DecodeErrCmd(sparams)
-		}
-		if scmd == "D" {
-			data = append(data, []byte(sparams)...)
+			cmdErr := ses.decodeErr(sparams)
+			if err := ses.checkTrailing(); err != nil {
+				return Result{}, err
+			}
+			if protoErr != nil && protoErr != ErrResponseTooLarge {
+				return Result{}, protoErr
+			}
+			if ses.ReturnPartialOnError && protoErr == nil {
+				return res, cmdErr
+			}
+			return Result{}, cmdErr
+		case "D":
+			if protoErr != nil {
+				continue
+			}
+			chunk, err := dec.decode(sparams)
+			if err != nil {
+				return Result{}, err
+			}
+			var ok bool
+			if res.Data, ok = ses.bufferData(res.Data, chunk); !ok {
+				protoErr = ErrResponseTooLarge
+			}
+		case "S":
+			keyword, value, err := common.ParseStatus(sparams)
+			if err != nil {
+				return Result{}, err
+			}
+			res.Status = append(res.Status, StatusLine{Keyword: keyword, Value: value})
+		case "INQUIRE":
+			Logger.Println("... unexpected inquiry:", sparams)
+			if err := ses.Pipe.WriteLine("CAN", ""); err != nil {
+				return Result{}, err
+			}
+			protoErr = unexpectedLine(scmd, sparams)
+		default:
+			return Result{}, unexpectedLine(scmd, sparams)
 		}
 	}
 }
 
 // Transact sends command with specified params and uses byte arrays in data
-// argument to answer server's inquiries. Values in data can be either []byte
-// or pointer to implementer of io.Reader or encoding.TextMarhshaller.
+// argument to answer server's inquiries. Values in data can be either []byte,
+// string, FileData or pointer to implementer of io.WriterTo, io.Reader,
+// encoding.TextMarhshaller or encoding.BinaryMarshaler.
+//
+// Keys of data are inquiry keywords, parameters sent by server after
+// keyword are not used for lookup, i.e. "INQUIRE NEEDPIN ||Enter PIN" is
+// answered using value with key "NEEDPIN".
+//
+// If line sent by server is longer than line length limit, it is skipped
+// (too long INQUIRE is cancelled) and *common.LineTooLongError is returned
+// after the rest of response is read.
 func (ses *Session) Transact(cmd string, params string, data map[string]interface{}) (rdata []byte, err error) {
+	if err := ses.lock(); err != nil {
+		return nil, err
+	}
+	defer ses.unlock()
+	return ses.transact(cmd, params, data)
+}
+
+func (ses *Session) transact(cmd string, params string, data map[string]interface{}) (rdata []byte, err error) {
 	Logger.Println("Initiating transaction:", cmd, params)
 	err = ses.Pipe.WriteLine(cmd, params)
 	if err != nil {
 		return nil, err
 	}
+	defer ses.releaseBuffered()
+
+	tooLarge := false
+	var dec dataDecoder
+	// Set if inquiry line was too long or inquiry can't be answered, it is
+	// cancelled and error is returned after server's response to CAN.
+	var inquiryErr error
 
 	for {
-		scmd, sparams, err := ses.Pipe.ReadLine()
+		scmd, sparams, err := ses.readLine()
 		if err != nil {
-			return nil, err
+			lerr, err := ses.skipLongLine(err)
+			if err != nil {
+				return nil, err
+			}
+			if inquiryErr == nil {
+				inquiryErr = lerr
+			}
+			continue
 		}
 
 		if scmd == "INQUIRE" {
-			inquireResp, prs := data[sparams]
+			keyword := inquiryKeyword(sparams)
+			inquireResp, prs := data[keyword]
 			if !prs {
 				Logger.Println("... unknown request:", sparams)
 				if err := ses.Pipe.WriteLine("CAN", ""); err != nil {
 					return nil, err
 				}
 
-				// We asked for FOO but we don't have FOO.
-				return nil, errors.New("missing data with keyword " + sparams)
+				// We asked for FOO but we don't have FOO. Error is
+				// returned after server's response to CAN.
+				inquiryErr = errors.New("missing data with keyword " + keyword)
+				continue
 			}
 
-			switch inquireResp.(type) {
-			case []byte:
-				if err := ses.Pipe.WriteData(inquireResp.([]byte)); err != nil {
-					Logger.Println("... I/O error:", err)
-					return nil, err
-				}
-			case io.Reader:
-				if err := ses.Pipe.WriteDataReader(inquireResp.(io.Reader)); err != nil {
-					Logger.Println("... I/O error:", err)
-					return nil, err
-				}
-			case encoding.TextMarshaler:
-				marhshalled, err := inquireResp.(encoding.TextMarshaler).MarshalText()
-				if err != nil {
+			ses.beginInquiry()
+			err := ses.answerInquiry(keyword, inquireResp)
+			if cancelled := ses.endInquiry(); cancelled && (err == nil || errors.Is(err, errCancelled)) {
+				Logger.Println("... inquiry cancelled")
+				if err := ses.Pipe.WriteLine("CAN", ""); err != nil {
 					return nil, err
 				}
-				if err := ses.Pipe.WriteData(marhshalled); err != nil {
-					Logger.Println("... I/O error:", err)
+				// Server will respond with ERR.
+				continue
+			}
+			var aerr *inquiryAbortError
+			if errors.As(err, &aerr) {
+				Logger.Println("... inquiry aborted:", err)
+				if err := ses.Pipe.WriteLine("CAN", ""); err != nil {
 					return nil, err
 				}
-			default:
-				return nil, errors.New("invalid type in data map value")
+				// Server will respond with ERR, error is returned after it.
+				inquiryErr = err
+				continue
+			}
+			if err != nil {
+				return nil, err
 			}
 
 			if err := ses.Pipe.WriteLine("END", ""); err != nil {
 				Logger.Println("... I/O error:", err)
 				return nil, err
 			}
+			continue
 		}
 
 		// Same as SimpleCmd.
 		if scmd == "OK" {
+			ses.setLastError(nil)
+			if err := ses.checkTrailing(); err != nil {
+				return []byte{}, err
+			}
+			if inquiryErr != nil {
+				return []byte{}, inquiryErr
+			}
+			if tooLarge {
+				return []byte{}, ErrResponseTooLarge
+			}
+			if err := dec.finish(); err != nil {
+				return []byte{}, err
+			}
 			return rdata, nil
 		}
 		if scmd == "ERR" {
 			Logger.Println("... Received ERR: ", sparams)
-			return []byte{}, common.DecodeErrCmd(sparams)
+			cmdErr := ses.decodeErr(sparams)
+			if err := ses.checkTrailing(); err != nil {
+				return []byte{}, err
+			}
+			if inquiryErr != nil {
+				return []byte{}, inquiryErr
+			}
+			if ses.ReturnPartialOnError && !tooLarge {
+				return rdata, cmdErr
+			}
+			return []byte{}, cmdErr
 		}
 		if scmd == "D" {
 			Logger.Println("... Received data chunk")
-			rdata = append(rdata, []byte(sparams)...)
+			if tooLarge {
+				continue
+			}
+			chunk, err := dec.decode(sparams)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if rdata, ok = ses.bufferData(rdata, chunk); !ok {
+				tooLarge = true
+			}
+			continue
 		}
+		return nil, unexpectedLine(scmd, sparams)
+	}
+}
+
+// dataDecoder unescapes payload of data lines. Protocol requires each line
+// to be escaped separately, but some peers split escape sequences between
+// lines, so incomplete sequence at the end of line is kept until the next
+// one.
+type dataDecoder struct {
+	pending string
+}
+
+func (d *dataDecoder) decode(chunk string) (string, error) {
+	chunk = d.pending + chunk
+	d.pending = ""
+	if i := strings.LastIndexByte(chunk, '%'); i != -1 && len(chunk)-i < 3 {
+		chunk, d.pending = chunk[:i], chunk[i:]
+	}
+	return common.Unescape(chunk)
+}
+
+// finish returns error if data ended with incomplete escape sequence.
+func (d *dataDecoder) finish() error {
+	if d.pending != "" {
+		return errors.New("malformed data: incomplete escape sequence")
+	}
+	return nil
+}
+
+// bufferData appends chunk of response to data. false is returned (and
+// data is released) if MaxResponseSize is exceeded.
+func (ses *Session) bufferData(data []byte, chunk string) ([]byte, bool) {
+	ses.bufLck.Lock()
+	defer ses.bufLck.Unlock()
+
+	if ses.MaxResponseSize != 0 && len(data)+len(chunk) > ses.MaxResponseSize {
+		Logger.Println("... response size limit exceeded, discarding remaining data")
+		ses.buffered = 0
+		return nil, false
+	}
+
+	data = append(data, chunk...)
+	ses.buffered = len(data)
+	if ses.buffered > ses.peakBuffered {
+		ses.peakBuffered = ses.buffered
+	}
+	return data, true
+}
+
+func (ses *Session) releaseBuffered() {
+	ses.bufLck.Lock()
+	defer ses.bufLck.Unlock()
+	ses.buffered = 0
+}
+
+// BufferedBytes returns amount of response data currently buffered by
+// command in progress (zero if there is none). Safe to call concurrently
+// with commands.
+func (ses *Session) BufferedBytes() int {
+	ses.bufLck.Lock()
+	defer ses.bufLck.Unlock()
+	return ses.buffered
+}
+
+// PeakBufferedBytes returns maximum amount of response data buffered by
+// single command over session lifetime.
+func (ses *Session) PeakBufferedBytes() int {
+	ses.bufLck.Lock()
+	defer ses.bufLck.Unlock()
+	return ses.peakBuffered
+}
+
+// SetCommentCallback sets function that will be called for each comment
+// line received during SimpleCmd or Transact, i.e. for lines of help text
+// sent in response to HELP command. Comment lines are discarded if
+// callback is not set.
+func (ses *Session) SetCommentCallback(f func(text string)) {
+	ses.mu.Lock()
+	defer ses.mu.Unlock()
+	ses.commentCb = f
+}
+
+// SetStatusCallback sets function that will be called for each status (S)
+// line received during SimpleCmd, Exec or Transact with keyword and
+// unescaped value. Status lines are discarded by SimpleCmd and Transact if
+// callback is not set, data sent together with them is returned as usual.
+//
+// Callback is called synchronously in the goroutine that reads response,
+// before command returns. Callback must not use Session.
+func (ses *Session) SetStatusCallback(f func(keyword, value string)) {
+	ses.mu.Lock()
+	defer ses.mu.Unlock()
+	ses.statusCb = f
+}
+
+// RawLine is a line received from server as passed to callback set using
+// SetLineCallback.
+type RawLine struct {
+	// Command, i.e. "D", "S", "OK" or "#" for comments.
+	Cmd string
+	// Parameters as received, still escaped. Use common.Unescape to get
+	// actual value.
+	Params string
+}
+
+// SetLineCallback sets function that will be called for each line received
+// from server as a part of response to command (SimpleCmd, Transact,
+// Stream, etc), including data, status and comment lines and final OK or
+// ERR.
+//
+// Callback is called synchronously, in exactly the same order as lines
+// were received and before line is processed by Session, so relative order
+// of data and status lines is preserved. Callback must not use Session.
+func (ses *Session) SetLineCallback(f func(line RawLine)) {
+	ses.mu.Lock()
+	defer ses.mu.Unlock()
+	ses.lineCb = f
+}
+
+// readLineRaw is same as Pipe.ReadLineRaw but passes line to callback set
+// using SetLineCallback.
+func (ses *Session) readLineRaw() (cmd string, params string, err error) {
+	cmd, params, err = ses.Pipe.ReadLineRaw()
+	if err != nil {
+		return "", "", err
 	}
+	if ses.lineCb != nil {
+		ses.lineCb(RawLine{Cmd: cmd, Params: params})
+	}
+	return cmd, params, nil
+}
+
+// skipLongLine handles error returned while reading response. If err is
+// *common.LineTooLongError for line other than OK or ERR, the line is
+// already discarded by Pipe but the rest of response is still unread, so
+// lerr is returned and caller should continue reading, returning lerr
+// after response is complete. Too long INQUIRE is cancelled. Any other
+// error is returned as is.
+func (ses *Session) skipLongLine(err error) (lerr *common.LineTooLongError, ferr error) {
+	lerr, ok := err.(*common.LineTooLongError)
+	if !ok || lerr.Cmd == "OK" || lerr.Cmd == "ERR" {
+		return nil, err
+	}
+	Logger.Println("... skipping too long line:", lerr.Cmd)
+	if lerr.Cmd == "INQUIRE" {
+		if err := ses.Pipe.WriteLine("CAN", ""); err != nil {
+			return nil, err
+		}
+	}
+	return lerr, nil
+}
+
+// readLine is same as Pipe.ReadLine but passes comments to callback. Data
+// lines are not unescaped, see readLineOrStatus.
+func (ses *Session) readLine() (cmd string, params string, err error) {
+	for {
+		cmd, params, err = ses.readLineOrStatus()
+		if err != nil || cmd != "S" {
+			return cmd, params, err
+		}
+	}
+}
+
+// readLineOrStatus is same as readLine but returns status lines too, their
+// parameters are left escaped to be parsed by common.ParseStatus.
+//
+// Parameters of data lines are left escaped too, use dataDecoder to
+// unescape them.
+func (ses *Session) readLineOrStatus() (cmd string, params string, err error) {
+	for {
+		cmd, params, err = ses.readLineRaw()
+		if err != nil {
+			return "", "", err
+		}
+
+		switch cmd {
+		case "#":
+			if ses.commentCb != nil {
+				ses.commentCb(unescapeComment(params))
+			}
+		case "S":
+			if ses.statusCb != nil {
+				keyword, value, err := common.ParseStatus(params)
+				if err != nil {
+					return "", "", err
+				}
+				ses.statusCb(keyword, value)
+			}
+			return cmd, params, nil
+		case "D":
+			return cmd, params, nil
+		default:
+			params, err = common.Unescape(params)
+			if err != nil {
+				return "", "", err
+			}
+			return cmd, params, nil
+		}
+	}
+}
+
+// unescapeComment unescapes text of comment line. Comments are not
+// required to be escaped, so text is returned as is if it is not valid.
+func unescapeComment(text string) string {
+	if unescaped, err := common.Unescape(text); err == nil {
+		return unescaped
+	}
+	return text
+}
+
+// LastError returns error sent by server in response to the last command,
+// nil if it succeeded.
+//
+// This is intended for diagnostics only and is not a substitute for
+// checking errors returned by Session methods, in particular I/O errors
+// and errors in malformed ERR responses are not reflected here.
+func (ses *Session) LastError() *common.Error {
+	ses.lastErrLck.Lock()
+	defer ses.lastErrLck.Unlock()
+	return ses.lastErr
+}
+
+func (ses *Session) setLastError(err *common.Error) {
+	ses.lastErrLck.Lock()
+	defer ses.lastErrLck.Unlock()
+	ses.lastErr = err
+}
+
+// decodeErr decodes parameters of ERR response and remembers it for
+// LastError.
+func (ses *Session) decodeErr(params string) error {
+	err := common.DecodeErrCmd(params)
+	if perr, ok := err.(common.Error); ok {
+		ses.setLastError(&perr)
+	} else {
+		ses.setLastError(nil)
+	}
+	return err
+}
+
+// checkTrailing returns ErrTrailingData if Strict is set and there is
+// unread data in pipe.
+func (ses *Session) checkTrailing() error {
+	if !ses.Strict || ses.Pipe.Buffered() == 0 {
+		return nil
+	}
+	Logger.Println("... server sent", ses.Pipe.Buffered(), "bytes after end of response")
+	return ErrTrailingData
+}
+
+// inquiryKeyword extracts keyword from (unescaped) INQUIRE parameters.
+func inquiryKeyword(params string) string {
+	params = strings.TrimLeft(params, " ")
+	if i := strings.IndexByte(params, ' '); i != -1 {
+		return params[:i]
+	}
+	return params
+}
+
+// answerInquiry sends value from Transact's data map using D lines. END
+// is not sent.
+func (ses *Session) answerInquiry(keyword string, val interface{}) error {
+	if ses.cancelRequested() {
+		return errCancelled
+	}
+
+	switch val.(type) {
+	case []byte:
+		if err := ses.Pipe.WriteData(val.([]byte)); err != nil {
+			Logger.Println("... I/O error:", err)
+			return err
+		}
+	case string:
+		if err := ses.Pipe.WriteData([]byte(val.(string))); err != nil {
+			Logger.Println("... I/O error:", err)
+			return err
+		}
+	case FileData:
+		if err := ses.sendFile(val.(FileData).Path); err != nil {
+			return fmt.Errorf("failed to send file for keyword %s: %w", keyword, err)
+		}
+	case io.WriterTo:
+		w := dataWriter{ses: ses}
+		if _, err := val.(io.WriterTo).WriteTo(&w); err != nil {
+			Logger.Println("... I/O error:", err)
+			return err
+		}
+		Logger.Println("... sent", w.n, "bytes")
+	case io.Reader:
+		if err := ses.Pipe.WriteDataReader(cancelReader{r: val.(io.Reader), ses: ses}); err != nil {
+			Logger.Println("... I/O error:", err)
+			return err
+		}
+	case encoding.TextMarshaler:
+		marhshalled, err := val.(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			Logger.Println("... failed to marshal data:", err)
+			return &inquiryAbortError{err: err}
+		}
+		if err := ses.Pipe.WriteData(marhshalled); err != nil {
+			Logger.Println("... I/O error:", err)
+			return err
+		}
+	case encoding.BinaryMarshaler:
+		marhshalled, err := val.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			Logger.Println("... failed to marshal data:", err)
+			return &inquiryAbortError{err: err}
+		}
+		if err := ses.Pipe.WriteData(marhshalled); err != nil {
+			Logger.Println("... I/O error:", err)
+			return err
+		}
+	default:
+		Logger.Printf("... invalid data type for %s: %T", keyword, val)
+		return &inquiryAbortError{err: fmt.Errorf("invalid type in data map value for keyword %s: %T", keyword, val)}
+	}
+	return nil
+}
+
+// FileData can be used as a value in Transact's data map to send contents of
+// file as a response to inquiry. File is opened when it is inquired and
+// closed after sending.
+type FileData struct {
+	Path string
+}
+
+// sendFile sends contents of file using D lines. If file can't be opened,
+// *inquiryAbortError is returned so inquiry is cancelled.
+func (ses *Session) sendFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		Logger.Println("... failed to open file:", err)
+		return &inquiryAbortError{err: err}
+	}
+	defer f.Close()
+
+	if err := ses.Pipe.WriteDataReader(f); err != nil {
+		Logger.Println("... I/O error:", err)
+		return err
+	}
+	return nil
+}
+
+// dataWriter is an io.Writer that sends everything written to it using D
+// commands. Used to stream data from io.WriterTo implementers.
+type dataWriter struct {
+	ses *Session
+	n   int64
+}
+
+func (w *dataWriter) Write(p []byte) (int, error) {
+	if w.ses.cancelRequested() {
+		return 0, errCancelled
+	}
+	if err := w.ses.Pipe.WriteData(p); err != nil {
+		return 0, err
+	}
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// cancelReader is an io.Reader that stops returning data once
+// Session.Cancel is called.
+type cancelReader struct {
+	r   io.Reader
+	ses *Session
+}
+
+func (r cancelReader) Read(p []byte) (int, error) {
+	if r.ses.cancelRequested() {
+		return 0, errCancelled
+	}
+	return r.r.Read(p)
+}
+
+// ErrNoInquiry is returned by Cancel if there is no inquiry being answered.
+var ErrNoInquiry = errors.New("no inquiry in progress")
+
+var errCancelled = errors.New("inquiry cancelled")
+
+// inquiryAbortError is returned by answerInquiry if inquiry can't be
+// answered and nothing was sent yet. Transact sends CAN, reads server's
+// response to it and returns wrapped error.
+type inquiryAbortError struct {
+	err error
+}
+
+func (e *inquiryAbortError) Error() string {
+	return e.err.Error()
+}
+
+func (e *inquiryAbortError) Unwrap() error {
+	return e.err
+}
+
+// Cancel aborts sending of data in response to server's inquiry by
+// Transact running in another goroutine. Instead of remaining data, CAN is
+// sent and Transact returns error sent by server in response to it.
+//
+// According to protocol, CAN can be sent by client only in response to
+// INQUIRE, so Cancel returns ErrNoInquiry if there is no inquiry being
+// answered. Data is checked for cancellation between chunks, so read from
+// io.Reader that blocks is not interrupted.
+func (ses *Session) Cancel() error {
+	ses.cancelLck.Lock()
+	defer ses.cancelLck.Unlock()
+	if !ses.inquiring {
+		return ErrNoInquiry
+	}
+	Logger.Println("Cancelling inquiry...")
+	ses.cancelled = true
+	return nil
+}
+
+// Closed reports whether Close was called.
+func (ses *Session) Closed() bool {
+	ses.cancelLck.Lock()
+	defer ses.cancelLck.Unlock()
+	return ses.closed
+}
+
+// lock acquires session for an operation. In strict mode it fails with
+// ErrWrongState instead of waiting if session is not idle. ErrSessionClosed
+// is returned if session is closed.
+func (ses *Session) lock() error {
+	if ses.Strict {
+		ses.cancelLck.Lock()
+		busy := ses.busy
+		ses.cancelLck.Unlock()
+		if busy {
+			Logger.Println("Session is not idle, rejecting operation")
+			return ErrWrongState
+		}
+	}
+
+	ses.mu.Lock()
+	ses.cancelLck.Lock()
+	defer ses.cancelLck.Unlock()
+	if ses.closed {
+		ses.mu.Unlock()
+		return ErrSessionClosed
+	}
+	ses.busy = true
+	return nil
+}
+
+func (ses *Session) unlock() {
+	ses.cancelLck.Lock()
+	ses.busy = false
+	ses.cancelLck.Unlock()
+	ses.mu.Unlock()
+}
+
+func (ses *Session) beginInquiry() {
+	ses.cancelLck.Lock()
+	defer ses.cancelLck.Unlock()
+	ses.inquiring, ses.cancelled = true, false
+}
+
+// endInquiry returns whether Cancel was called during inquiry.
+func (ses *Session) endInquiry() bool {
+	ses.cancelLck.Lock()
+	defer ses.cancelLck.Unlock()
+	cancelled := ses.cancelled
+	ses.inquiring, ses.cancelled = false, false
+	return cancelled
+}
+
+func (ses *Session) cancelRequested() bool {
+	ses.cancelLck.Lock()
+	defer ses.cancelLck.Unlock()
+	return ses.cancelled
 }
 
 // Option sets options for connections.
@@ -192,3 +1107,185 @@ func (ses *Session) Option(name string, value string) error {
 	_, err := ses.SimpleCmd("OPTION", name+" = "+value)
 	return err
 }
+
+// SetLineLength asks server to raise line length limit to n bytes (see
+// server.ProtoInfo.MaxNegotiatedLineLen) and applies it to session if
+// server agreed.
+//
+// Most Assuan servers (including GnuPG) don't support this extension and
+// respond with error.
+func (ses *Session) SetLineLength(n int) error {
+	if err := ses.lock(); err != nil {
+		return err
+	}
+	defer ses.unlock()
+
+	if _, err := ses.simpleCmd("OPTION", "line-length="+strconv.Itoa(n)); err != nil {
+		return err
+	}
+	return ses.Pipe.SetMaxLineLen(n)
+}
+
+// Supports checks whether server supports command by sending HELP with
+// command name.
+//
+// Server that doesn't implement HELP command at all causes error to be
+// returned, not false.
+func (ses *Session) Supports(cmd string) (bool, error) {
+	Logger.Println("Checking whether", cmd, "is supported...")
+	_, err := ses.SimpleCmd("HELP", cmd)
+	if err == nil {
+		return true, nil
+	}
+	if perr, ok := err.(common.Error); ok {
+		switch perr.Code {
+		case common.ErrNotFound, common.ErrUnknownCommand:
+			return false, nil
+		}
+	}
+	return false, err
+}
+
+// Tx provides access to session commands inside of Batch.
+type Tx struct {
+	ses *Session
+}
+
+// SimpleCmd is same as Session.SimpleCmd.
+func (tx *Tx) SimpleCmd(cmd string, params string) (data []byte, err error) {
+	return tx.ses.simpleCmd(cmd, params)
+}
+
+// Transact is same as Session.Transact.
+func (tx *Tx) Transact(cmd string, params string, data map[string]interface{}) (rdata []byte, err error) {
+	return tx.ses.transact(cmd, params, data)
+}
+
+// Option is same as Session.Option.
+func (tx *Tx) Option(name string, value string) error {
+	_, err := tx.ses.simpleCmd("OPTION", name+" = "+value)
+	return err
+}
+
+// Reset is same as Session.Reset.
+func (tx *Tx) Reset() error {
+	_, err := tx.ses.simpleCmd("RESET", "")
+	return err
+}
+
+// Batch calls f while preventing other goroutines from using the session,
+// so commands sent using tx are not interleaved with commands sent by
+// them.
+//
+// There is no rollback: if f fails in the middle, commands executed before
+// the failure still have their effect on server. Error returned by f is
+// returned from Batch as is.
+//
+// tx is valid only until f returns. Session methods must not be called
+// from f, that will cause a deadlock (or ErrWrongState in strict mode).
+func (ses *Session) Batch(f func(tx *Tx) error) error {
+	if err := ses.lock(); err != nil {
+		return err
+	}
+	defer ses.unlock()
+	return f(&Tx{ses: ses})
+}
+
+// Help returns list of commands supported by server (as reported by HELP
+// command).
+func (ses *Session) Help() ([]string, error) {
+	return ses.HelpFor("")
+}
+
+// HelpFor returns help text for specified command split into lines.
+//
+// Empty slice is returned for commands without help text.
+func (ses *Session) HelpFor(cmd string) ([]string, error) {
+	if err := ses.lock(); err != nil {
+		return nil, err
+	}
+	defer ses.unlock()
+
+	Logger.Println("Requesting help for", cmd+"...")
+	if err := ses.Pipe.WriteLine("HELP", cmd); err != nil {
+		Logger.Println("... I/O error:", err)
+		return nil, err
+	}
+
+	lines := []string{}
+	var longErr error
+	for {
+		scmd, sparams, err := ses.readLineRaw()
+		if err != nil {
+			lerr, err := ses.skipLongLine(err)
+			if err != nil {
+				Logger.Println("... I/O error:", err)
+				return nil, err
+			}
+			if longErr == nil {
+				longErr = lerr
+			}
+			continue
+		}
+
+		switch scmd {
+		case "#":
+			lines = append(lines, unescapeComment(sparams))
+		case "OK":
+			ses.setLastError(nil)
+			if longErr != nil {
+				return nil, longErr
+			}
+			return lines, nil
+		case "ERR":
+			sparams, err := common.Unescape(sparams)
+			if err != nil {
+				return nil, err
+			}
+			Logger.Println("... Received ERR: ", sparams)
+			if longErr != nil {
+				return nil, longErr
+			}
+			return nil, ses.decodeErr(sparams)
+		}
+	}
+}
+
+// WriteRaw sends p to server as is, bypassing command abstraction. It is
+// intended for experimenting with protocol extensions.
+//
+// Server's response should be read completely using ReadRawLine before
+// using any other Session methods, otherwise they will see it as response
+// to their command. Use WithRawPipe if several raw operations should not be
+// interleaved with other goroutines.
+func (ses *Session) WriteRaw(p []byte) error {
+	if err := ses.lock(); err != nil {
+		return err
+	}
+	defer ses.unlock()
+	return ses.Pipe.WriteRaw(p)
+}
+
+// ReadRawLine reads single line sent by server without any processing
+// (see WriteRaw, common.Pipe.ReadLineVerbatim). Line terminator is not
+// included, empty lines and comments are returned too.
+func (ses *Session) ReadRawLine() (string, error) {
+	if err := ses.lock(); err != nil {
+		return "", err
+	}
+	defer ses.unlock()
+	return ses.Pipe.ReadLineVerbatim()
+}
+
+// WithRawPipe calls f with underlying pipe while preventing other
+// goroutines from using the session.
+//
+// f is responsible for leaving the stream in consistent state, i.e. it
+// should read the complete response for each command it sends.
+func (ses *Session) WithRawPipe(f func(pipe *common.Pipe) error) error {
+	if err := ses.lock(); err != nil {
+		return err
+	}
+	defer ses.unlock()
+	return f(&ses.Pipe)
+}
@@ -2,13 +2,22 @@ package client_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	assuan "github.com/foxcpp/go-assuan/client"
 	"github.com/foxcpp/go-assuan/common"
+	"github.com/foxcpp/go-assuan/server"
 )
 
 func ExampleSession() {
@@ -47,6 +56,40 @@ func TestInitClose(t *testing.T) {
 	}
 }
 
+func TestSession_UseAfterClose(t *testing.T) {
+	clReq := bytes.Buffer{}
+	ses, err := assuan.Init(common.ReadWriter{Reader: strings.NewReader("OK Pleased to meet you\n"), Writer: &clReq})
+	if err != nil {
+		t.Fatal("Unexpected error on client.Init:", err)
+	}
+
+	if ses.Closed() {
+		t.Error("Session is closed before Close")
+	}
+	if err := ses.Close(); err != nil {
+		t.Fatal("Unexpected Close error:", err)
+	}
+	if !ses.Closed() {
+		t.Error("Session is not closed after Close")
+	}
+
+	if _, err := ses.SimpleCmd("NOP", ""); err != assuan.ErrSessionClosed {
+		t.Error("Expected ErrSessionClosed from SimpleCmd, got:", err)
+	}
+	if _, err := ses.Transact("NOP", "", nil); err != assuan.ErrSessionClosed {
+		t.Error("Expected ErrSessionClosed from Transact, got:", err)
+	}
+	if _, err := ses.Stream("NOP", ""); err != assuan.ErrSessionClosed {
+		t.Error("Expected ErrSessionClosed from Stream, got:", err)
+	}
+	if err := ses.Close(); err != nil {
+		t.Error("Unexpected error on second Close:", err)
+	}
+	if clReq.String() != "BYE\n" {
+		t.Errorf("Unexpected data sent after Close: %q", clReq.String())
+	}
+}
+
 func TestSession_SimpleCmd(t *testing.T) {
 	srvResp := strings.NewReader(`OK Pleased to meet you
 OK`)
@@ -89,6 +132,237 @@ OK`)
 	}
 }
 
+func TestSession_SimpleCmdPartialData(t *testing.T) {
+	srvResp := `OK Pleased to meet you
+D ABC
+D DEF
+ERR 536871187 Unknown IPC command <User defined source 1>
+`
+
+	t.Run("discarded by default", func(t *testing.T) {
+		ses, err := assuan.Init(common.ReadWriter{Reader: strings.NewReader(srvResp), Writer: &bytes.Buffer{}})
+		if err != nil {
+			t.Log("Unexpected error on client.Init:", err)
+			t.FailNow()
+		}
+
+		data, err := ses.SimpleCmd("TESTCMD", "")
+		if err == nil {
+			t.Error("client.SimpleCmd didn't returned error")
+		}
+		if len(data) != 0 {
+			t.Error("Unexpected data received:", string(data))
+		}
+	})
+	t.Run("ReturnPartialOnError", func(t *testing.T) {
+		ses, err := assuan.Init(common.ReadWriter{Reader: strings.NewReader(srvResp), Writer: &bytes.Buffer{}})
+		if err != nil {
+			t.Log("Unexpected error on client.Init:", err)
+			t.FailNow()
+		}
+		ses.ReturnPartialOnError = true
+
+		data, err := ses.SimpleCmd("TESTCMD", "")
+		if err == nil {
+			t.Error("client.SimpleCmd didn't returned error")
+		}
+		if string(data) != "ABCDEF" {
+			t.Error("Wrong data received:", string(data))
+		}
+	})
+}
+
+func TestSession_Exec(t *testing.T) {
+	cases := []struct {
+		name     string
+		resp     string
+		expected assuan.Result
+	}{
+		{"data only", "D ABC\nD DEF\nOK\n", assuan.Result{Data: []byte("ABCDEF")}},
+		{"status only", "S PROGRESS foo 1 10\nS NEW_PIN\nOK done\n", assuan.Result{
+			Status: []assuan.StatusLine{
+				{Keyword: "PROGRESS", Value: "foo 1 10"},
+				{Keyword: "NEW_PIN"},
+			},
+			OK: "done",
+		}},
+		{"mixed", "S INQUIRE_MAXLEN 100\nD AB\n# comment\nS SIG_CREATED D\nD C%25\nOK\n", assuan.Result{
+			Data: []byte("ABC%"),
+			Status: []assuan.StatusLine{
+				{Keyword: "INQUIRE_MAXLEN", Value: "100"},
+				{Keyword: "SIG_CREATED", Value: "D"},
+			},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srvResp := strings.NewReader("OK Pleased to meet you\n" + c.resp)
+			ses, err := assuan.Init(common.ReadWriter{Reader: srvResp, Writer: &bytes.Buffer{}})
+			if err != nil {
+				t.Fatal("Unexpected error on client.Init:", err)
+			}
+
+			res, err := ses.Exec("TESTCMD", "")
+			if err != nil {
+				t.Fatal("Unexpected error on client.Exec:", err)
+			}
+			if !reflect.DeepEqual(res, c.expected) {
+				t.Errorf("Wrong result: wanted %#v, got %#v", c.expected, res)
+			}
+		})
+	}
+}
+
+func TestSession_SplitEscape(t *testing.T) {
+	t.Run("SimpleCmd", func(t *testing.T) {
+		srvResp := "OK Pleased to meet you\nD AB%2\nD 5CD%\nD 0A\nOK\n"
+		ses, err := assuan.Init(common.ReadWriter{Reader: strings.NewReader(srvResp), Writer: &bytes.Buffer{}})
+		if err != nil {
+			t.Fatal("Unexpected error on client.Init:", err)
+		}
+
+		data, err := ses.SimpleCmd("TESTCMD", "")
+		if err != nil {
+			t.Fatal("Unexpected error on client.SimpleCmd:", err)
+		}
+		if string(data) != "AB%CD\n" {
+			t.Errorf("Wrong data received: %q", data)
+		}
+	})
+	t.Run("Transact", func(t *testing.T) {
+		srvResp := "OK Pleased to meet you\nINQUIRE FOO\nD %\nD 25%0\nD D\nOK\n"
+		ses, err := assuan.Init(common.ReadWriter{Reader: strings.NewReader(srvResp), Writer: &bytes.Buffer{}})
+		if err != nil {
+			t.Fatal("Unexpected error on client.Init:", err)
+		}
+
+		data, err := ses.Transact("TESTCMD", "", map[string]interface{}{"FOO": "foo"})
+		if err != nil {
+			t.Fatal("Unexpected error on client.Transact:", err)
+		}
+		if string(data) != "%\r" {
+			t.Errorf("Wrong data received: %q", data)
+		}
+	})
+	t.Run("incomplete escape", func(t *testing.T) {
+		srvResp := "OK Pleased to meet you\nD AB%2\nOK\n"
+		ses, err := assuan.Init(common.ReadWriter{Reader: strings.NewReader(srvResp), Writer: &bytes.Buffer{}})
+		if err != nil {
+			t.Fatal("Unexpected error on client.Init:", err)
+		}
+
+		if _, err := ses.SimpleCmd("TESTCMD", ""); err == nil {
+			t.Error("Expected error for incomplete escape sequence")
+		}
+	})
+}
+
+func TestSession_Strict(t *testing.T) {
+	t.Run("trailing data", func(t *testing.T) {
+		srvResp := "OK Pleased to meet you\nD ABC\nOK\nD garbage\n"
+		ses, err := assuan.Init(common.ReadWriter{Reader: strings.NewReader(srvResp), Writer: &bytes.Buffer{}})
+		if err != nil {
+			t.Fatal("Unexpected error on client.Init:", err)
+		}
+		ses.Strict = true
+
+		if _, err := ses.SimpleCmd("TESTCMD", ""); err != assuan.ErrTrailingData {
+			t.Error("Expected ErrTrailingData, got:", err)
+		}
+	})
+	t.Run("clean response", func(t *testing.T) {
+		srvResp := "OK Pleased to meet you\nD ABC\nOK\n"
+		ses, err := assuan.Init(common.ReadWriter{Reader: strings.NewReader(srvResp), Writer: &bytes.Buffer{}})
+		if err != nil {
+			t.Fatal("Unexpected error on client.Init:", err)
+		}
+		ses.Strict = true
+
+		data, err := ses.SimpleCmd("TESTCMD", "")
+		if err != nil {
+			t.Fatal("Unexpected error on client.SimpleCmd:", err)
+		}
+		if string(data) != "ABC" {
+			t.Error("Wrong data received:", string(data))
+		}
+	})
+	t.Run("wrong state", strictStateTest)
+}
+
+type reentrantReader struct {
+	ses *assuan.Session
+	err error
+}
+
+func (r *reentrantReader) Read(p []byte) (int, error) {
+	_, r.err = r.ses.SimpleCmd("NOP", "")
+	return 0, io.EOF
+}
+
+func strictStateTest(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"LIST": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return nil, pipe.WriteData([]byte("item"))
+			},
+			"SETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				_, perr, err := server.Inquire(pipe, []string{"DATA"})
+				return perr, err
+			},
+		},
+	})
+	defer ses.Close()
+	ses.Strict = true
+
+	t.Run("command while streaming", func(t *testing.T) {
+		it, err := ses.Stream("LIST", "")
+		if err != nil {
+			t.Fatal("Unexpected Stream error:", err)
+		}
+		if _, err := ses.SimpleCmd("NOP", ""); err != assuan.ErrWrongState {
+			t.Error("Expected ErrWrongState, got:", err)
+		}
+		if _, err := ses.Stream("LIST", ""); err != assuan.ErrWrongState {
+			t.Error("Expected ErrWrongState, got:", err)
+		}
+		if err := it.Close(); err != nil {
+			t.Error("Unexpected Close error:", err)
+		}
+	})
+	t.Run("command during inquiry", func(t *testing.T) {
+		r := &reentrantReader{ses: ses}
+		if _, err := ses.Transact("SETDATA", "", map[string]interface{}{"DATA": r}); err != nil {
+			t.Error("Unexpected Transact error:", err)
+		}
+		if r.err != assuan.ErrWrongState {
+			t.Error("Expected ErrWrongState, got:", r.err)
+		}
+	})
+	t.Run("raw write while awaiting response", func(t *testing.T) {
+		var rawErr error
+		ses.SetLineCallback(func(assuan.RawLine) {
+			rawErr = ses.WriteRaw([]byte("NOP\n"))
+		})
+		defer ses.SetLineCallback(nil)
+		if _, err := ses.SimpleCmd("LIST", ""); err != nil {
+			t.Error("Unexpected SimpleCmd error:", err)
+		}
+		if rawErr != assuan.ErrWrongState {
+			t.Error("Expected ErrWrongState, got:", rawErr)
+		}
+	})
+	t.Run("cancel while idle", func(t *testing.T) {
+		if err := ses.Cancel(); err != assuan.ErrNoInquiry {
+			t.Error("Expected ErrNoInquiry, got:", err)
+		}
+	})
+
+	// Rejected operations should not affect session.
+	if _, err := ses.SimpleCmd("NOP", ""); err != nil {
+		t.Error("Unexpected SimpleCmd error:", err)
+	}
+}
+
 type DummmyMarhshaller struct {
 	s string
 }
@@ -97,6 +371,12 @@ func (dm DummmyMarhshaller) MarshalText() ([]byte, error) {
 	return []byte(dm.s), nil
 }
 
+type failingMarshaller struct{}
+
+func (failingMarshaller) MarshalText() ([]byte, error) {
+	return nil, errors.New("marshal failed")
+}
+
 func TestSession_Transact(t *testing.T) {
 	srvResp := strings.NewReader(`OK Pleased to meet you
 INQUIRE foo
@@ -139,3 +419,977 @@ END
 		t.Error("Got:", clReq.Bytes())
 	}
 }
+
+type DummyWriterTo struct {
+	s string
+}
+
+func (dw DummyWriterTo) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, dw.s)
+	return int64(n), err
+}
+
+type DummyBinaryMarshaller struct {
+	b []byte
+}
+
+func (dm DummyBinaryMarshaller) MarshalBinary() ([]byte, error) {
+	return dm.b, nil
+}
+
+func TestSession_TransactEscapedData(t *testing.T) {
+	srvResp := strings.NewReader("OK\nINQUIRE foo\nD 100%25%0D\nD %0Adone\nOK\n")
+	ses, err := assuan.Init(common.ReadWriter{Reader: srvResp, Writer: ioutil.Discard})
+	if err != nil {
+		t.Fatal("Unexpected error on client.Init:", err)
+	}
+	defer ses.Close()
+
+	data, err := ses.Transact("CMD", "", map[string]interface{}{"foo": []byte("FOO")})
+	if err != nil {
+		t.Fatal("Unexpected error on client.Transact:", err)
+	}
+	if string(data) != "100%\r\ndone" {
+		t.Errorf("Wrong data: %q", data)
+	}
+}
+
+func TestSession_TransactKeywordParams(t *testing.T) {
+	srvResp := strings.NewReader("OK Pleased to meet you\n" +
+		"INQUIRE NEEDPIN ||Please enter the PIN\n" +
+		"INQUIRE PINENTRY_LAUNCHED 1234 curses 1.1.0 - xterm%0A\n" +
+		"INQUIRE  PASSPHRASE\n" +
+		"OK\n")
+	clReq := bytes.Buffer{}
+	ses, err := assuan.Init(common.ReadWriter{Reader: srvResp, Writer: &clReq})
+	if err != nil {
+		t.Fatal("Unexpected error on client.Init:", err)
+	}
+
+	_, err = ses.Transact("CMD", "", map[string]interface{}{
+		"NEEDPIN":           "1234",
+		"PINENTRY_LAUNCHED": "",
+		"PASSPHRASE":        "secret",
+	})
+	if err != nil {
+		t.Fatal("Unexpected error on client.Transact:", err)
+	}
+	if clReq.String() != "CMD\nD 1234\nEND\nEND\nD secret\nEND\n" {
+		t.Errorf("Wrong client output: %q", clReq.String())
+	}
+}
+
+func TestSession_TransactLongInquiry(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"SETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				if err := pipe.WriteRaw([]byte("INQUIRE " + strings.Repeat("X", 2*common.MaxLineLen) + "\n")); err != nil {
+					return nil, err
+				}
+				cmd, _, err := pipe.ReadLine()
+				if err != nil {
+					return nil, err
+				}
+				if cmd != "CAN" {
+					return nil, fmt.Errorf("unexpected response to inquiry: %s", cmd)
+				}
+				return common.NewAssuanError(common.ErrAssCanceled, "inquiry cancelled"), nil
+			},
+		},
+	})
+	defer ses.Close()
+
+	_, err := ses.Transact("SETDATA", "", map[string]interface{}{})
+	if lerr, ok := err.(*common.LineTooLongError); !ok || lerr.Cmd != "INQUIRE" {
+		t.Fatal("Expected LineTooLongError, got:", err)
+	}
+	if _, err := ses.SimpleCmd("NOP", ""); err != nil {
+		t.Error("Session is not usable after too long inquiry:", err)
+	}
+}
+
+func TestSession_LongResponseLine(t *testing.T) {
+	long := strings.Repeat("x", 2*common.MaxLineLen)
+	for _, c := range []struct {
+		name string
+		cmd  func(ses *assuan.Session) error
+	}{
+		{"SimpleCmd", func(ses *assuan.Session) error {
+			_, err := ses.SimpleCmd("KEYINFO", "")
+			return err
+		}},
+		{"Transact", func(ses *assuan.Session) error {
+			_, err := ses.Transact("KEYINFO", "", nil)
+			return err
+		}},
+		{"Stream", func(ses *assuan.Session) error {
+			it, err := ses.Stream("KEYINFO", "")
+			if err != nil {
+				return err
+			}
+			return it.Close()
+		}},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			ses := startTestServer(t, server.ProtoInfo{
+				Handlers: map[string]server.CommandHandler{
+					"KEYINFO": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+						if err := pipe.WriteRaw([]byte("S KEY " + long + "\n")); err != nil {
+							return nil, err
+						}
+						return nil, pipe.WriteRaw([]byte("D " + long + "\n"))
+					},
+					"GETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+						return nil, pipe.WriteData([]byte("second"))
+					},
+				},
+			})
+			defer ses.Close()
+
+			err := c.cmd(ses)
+			if lerr, ok := err.(*common.LineTooLongError); !ok || lerr.Cmd != "S" {
+				t.Fatal("Expected LineTooLongError for S line, got:", err)
+			}
+			data, err := ses.SimpleCmd("GETDATA", "")
+			if err != nil {
+				t.Fatal("Session is not usable after too long line:", err)
+			}
+			if string(data) != "second" {
+				t.Errorf("Response of previous command is read as response to next one: %q", data)
+			}
+		})
+	}
+}
+
+func TestSession_TransactDataTypes(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "go-assuan-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.WriteString("DATA"); err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Close()
+
+	accepted := map[string]interface{}{
+		"FileData":                 assuan.FileData{Path: tmpFile.Name()},
+		"[]byte":                   []byte("DATA"),
+		"string":                   "DATA",
+		"io.Reader":                io.LimitReader(strings.NewReader("DATA"), 4),
+		"io.WriterTo":              DummyWriterTo{s: "DATA"},
+		"encoding.TextMarshaler":   DummmyMarhshaller{s: "DATA"},
+		"encoding.BinaryMarshaler": DummyBinaryMarshaller{b: []byte("DATA")},
+	}
+	for name, val := range accepted {
+		val := val
+		t.Run(name, func(t *testing.T) {
+			srvResp := strings.NewReader(`OK Pleased to meet you
+INQUIRE foo
+OK
+`)
+			clReq := bytes.Buffer{}
+			ses, err := assuan.Init(common.ReadWriter{Reader: srvResp, Writer: &clReq})
+			if err != nil {
+				t.Log("Unexpected error on client.Init:", err)
+				t.FailNow()
+			}
+
+			_, err = ses.Transact("CMD", "", map[string]interface{}{"foo": val})
+			if err != nil {
+				t.Error("Unexpected error on client.Transact:", err)
+				t.FailNow()
+			}
+			if clReq.String() != "CMD\nD DATA\nEND\n" {
+				t.Errorf("Client sent different output: '%s'", clReq.String())
+			}
+		})
+	}
+
+	t.Run("rejected type", func(t *testing.T) {
+		srvResp := strings.NewReader(`OK Pleased to meet you
+INQUIRE foo
+OK
+`)
+		clReq := bytes.Buffer{}
+		ses, err := assuan.Init(common.ReadWriter{Reader: srvResp, Writer: &clReq})
+		if err != nil {
+			t.Log("Unexpected error on client.Init:", err)
+			t.FailNow()
+		}
+
+		_, err = ses.Transact("CMD", "", map[string]interface{}{"foo": 42})
+		if err == nil {
+			t.Error("client.Transact accepted int as inquiry data")
+			t.FailNow()
+		}
+		if !strings.Contains(err.Error(), "foo") || !strings.Contains(err.Error(), "int") {
+			t.Error("Error doesn't mention keyword and type:", err)
+		}
+		if clReq.String() != "CMD\nCAN\n" {
+			t.Errorf("Client sent different output: '%s'", clReq.String())
+		}
+	})
+	t.Run("marshal error", func(t *testing.T) {
+		srvResp := strings.NewReader(`OK Pleased to meet you
+INQUIRE foo
+ERR 83886179 IPC call has been cancelled
+OK
+`)
+		clReq := bytes.Buffer{}
+		ses, err := assuan.Init(common.ReadWriter{Reader: srvResp, Writer: &clReq})
+		if err != nil {
+			t.Fatal("Unexpected error on client.Init:", err)
+		}
+
+		_, err = ses.Transact("CMD", "", map[string]interface{}{"foo": failingMarshaller{}})
+		if err == nil || err.Error() != "marshal failed" {
+			t.Error("Expected marshal error, got:", err)
+		}
+		if clReq.String() != "CMD\nCAN\n" {
+			t.Errorf("Client sent different output: '%s'", clReq.String())
+		}
+		// ERR sent in response to CAN should be consumed.
+		if _, err := ses.SimpleCmd("NOP", ""); err != nil {
+			t.Error("Unexpected SimpleCmd error:", err)
+		}
+	})
+	t.Run("missing file", func(t *testing.T) {
+		srvResp := strings.NewReader(`OK Pleased to meet you
+INQUIRE foo
+OK
+`)
+		clReq := bytes.Buffer{}
+		ses, err := assuan.Init(common.ReadWriter{Reader: srvResp, Writer: &clReq})
+		if err != nil {
+			t.Fatal("Unexpected error on client.Init:", err)
+		}
+
+		_, err = ses.Transact("CMD", "", map[string]interface{}{"foo": assuan.FileData{Path: "/nonexistent/file"}})
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Error("Expected wrapped not-exist error, got:", err)
+		}
+		if clReq.String() != "CMD\nCAN\n" {
+			t.Errorf("Client sent different output: '%s'", clReq.String())
+		}
+	})
+}
+
+func TestSession_TransactMissingFile(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"SETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				_, perr, err := server.Inquire(pipe, []string{"DATA"})
+				return perr, err
+			},
+			"GETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return nil, pipe.WriteData([]byte("data"))
+			},
+		},
+	})
+	defer ses.Close()
+
+	_, err := ses.Transact("SETDATA", "", map[string]interface{}{"DATA": assuan.FileData{Path: "/nonexistent/file"}})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Error("Expected wrapped not-exist error, got:", err)
+	}
+
+	// Server's response to CAN should be consumed by Transact.
+	data, err := ses.SimpleCmd("GETDATA", "")
+	if err != nil {
+		t.Fatal("Unexpected SimpleCmd error:", err)
+	}
+	if string(data) != "data" {
+		t.Errorf("Wrong data: %q", data)
+	}
+}
+
+func serveTestProto(t *testing.T, proto server.ProtoInfo) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("Failed to create listener:", err)
+	}
+	go server.ServeNet(l, proto)
+	return l
+}
+
+func TestDialContext(t *testing.T) {
+	proto := server.ProtoInfo{
+		Greeting: "Pleased to meet you",
+		Handlers: map[string]server.CommandHandler{
+			"SLEEP": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				time.Sleep(500 * time.Millisecond)
+				return nil, nil
+			},
+		},
+		GetDefaultState: func() interface{} { return nil },
+	}
+	l := serveTestProto(t, proto)
+	defer l.Close()
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		ses, err := assuan.DialContext(ctx, "tcp", l.Addr().String())
+		if err != nil {
+			t.Error("Unexpected error on client.DialContext:", err)
+			t.FailNow()
+		}
+		if _, err := ses.SimpleCmd("NOP", ""); err != nil {
+			t.Error("Unexpected error on client.SimpleCmd:", err)
+		}
+
+		cancel()
+
+		// Connection is closed asynchronously.
+		for i := 0; ; i++ {
+			if _, err := ses.SimpleCmd("NOP", ""); err != nil {
+				break
+			}
+			if i == 100 {
+				t.Error("Connection is not closed after context cancellation")
+				t.FailNow()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		ses, err := assuan.DialContext(ctx, "tcp", l.Addr().String())
+		if err != nil {
+			t.Error("Unexpected error on client.DialContext:", err)
+			t.FailNow()
+		}
+		defer ses.Close()
+
+		start := time.Now()
+		if _, err := ses.SimpleCmd("SLEEP", ""); err == nil {
+			t.Error("client.SimpleCmd didn't failed after deadline")
+		}
+		if time.Since(start) > 400*time.Millisecond {
+			t.Error("client.SimpleCmd returned too late:", time.Since(start))
+		}
+	})
+}
+
+// startTestServer runs server.Serve with passed protocol in separate
+// goroutine and returns session connected to it.
+func startTestServer(t *testing.T, proto server.ProtoInfo) *assuan.Session {
+	if proto.GetDefaultState == nil {
+		proto.GetDefaultState = func() interface{} { return nil }
+	}
+
+	srvConn, clConn := net.Pipe()
+	go func() {
+		defer srvConn.Close()
+		server.Serve(srvConn, proto)
+	}()
+
+	ses, err := assuan.Init(clConn)
+	if err != nil {
+		t.Error("Unexpected error on client.Init:", err)
+		t.FailNow()
+	}
+	return ses
+}
+
+func TestSession_DataRoundTrip(t *testing.T) {
+	payload := make([]byte, 0, 64*1024)
+	for i := 0; len(payload) < cap(payload); i++ {
+		payload = append(payload, byte(i), '\n', '%', 0, '\r', '\\', 0xFF)
+	}
+
+	proto := server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"GETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return nil, pipe.WriteData(payload)
+			},
+		},
+		GetDefaultState: func() interface{} { return nil },
+	}
+	ses := startTestServer(t, proto)
+	defer ses.Close()
+
+	data, err := ses.SimpleCmd("GETDATA", "")
+	if err != nil {
+		t.Error("Unexpected error on client.SimpleCmd:", err)
+		t.FailNow()
+	}
+	if !bytes.Equal(data, payload) {
+		t.Errorf("Received data differs from sent data (len %d, wanted %d)", len(data), len(payload))
+	}
+
+	res, err := ses.Exec("GETDATA", "")
+	if err != nil {
+		t.Fatal("Unexpected error on client.Exec:", err)
+	}
+	if !bytes.Equal(res.Data, payload) || len(res.Status) != 0 || res.OK != "" {
+		t.Errorf("Response is not data followed by bare OK: %d bytes, status %v, OK %q", len(res.Data), res.Status, res.OK)
+	}
+}
+
+func TestSession_Supports(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"CCMD": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) { return nil, nil },
+		},
+	})
+	defer ses.Close()
+
+	for cmd, expected := range map[string]bool{"CCMD": true, "NOP": true, "XCMD": false} {
+		supported, err := ses.Supports(cmd)
+		if err != nil {
+			t.Error("Unexpected error on client.Supports:", err)
+			continue
+		}
+		if supported != expected {
+			t.Errorf("Wrong result for %s: wanted %v, got %v", cmd, expected, supported)
+		}
+	}
+
+	t.Run("no HELP support", func(t *testing.T) {
+		srvResp := strings.NewReader(`OK Pleased to meet you
+ERR 536871187 Unknown IPC command <User defined source 1>
+`)
+		ses, err := assuan.Init(common.ReadWriter{Reader: srvResp, Writer: &bytes.Buffer{}})
+		if err != nil {
+			t.Log("Unexpected error on client.Init:", err)
+			t.FailNow()
+		}
+
+		if _, err := ses.Supports("CCMD"); err == nil {
+			t.Error("client.Supports didn't returned error")
+		}
+	})
+}
+
+func TestSession_Concurrent(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"ECHODATA": func(pipe *common.Pipe, _ interface{}, params string) (*common.Error, error) {
+				return nil, pipe.WriteData([]byte(params))
+			},
+		},
+	})
+	defer ses.Close()
+
+	errCh := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		param := strconv.Itoa(i)
+		go func() {
+			data, err := ses.SimpleCmd("ECHODATA", param)
+			if err == nil && string(data) != param {
+				err = fmt.Errorf("wrong data received: wanted %s, got %s", param, data)
+			}
+			errCh <- err
+		}()
+		go func() {
+			errCh <- ses.WithRawPipe(func(pipe *common.Pipe) error {
+				if err := pipe.WriteLine("NOP", ""); err != nil {
+					return err
+				}
+				cmd, _, err := pipe.ReadLine()
+				if err == nil && cmd != "OK" {
+					err = fmt.Errorf("unexpected response to NOP: %s", cmd)
+				}
+				return err
+			})
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := <-errCh; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSession_Batch(t *testing.T) {
+	type state struct{ val string }
+	ses := startTestServer(t, server.ProtoInfo{
+		GetDefaultState: func() interface{} { return &state{} },
+		Handlers: map[string]server.CommandHandler{
+			"SET": func(_ *common.Pipe, s interface{}, params string) (*common.Error, error) {
+				s.(*state).val = params
+				return nil, nil
+			},
+			"GET": func(pipe *common.Pipe, s interface{}, _ string) (*common.Error, error) {
+				return nil, pipe.WriteData([]byte(s.(*state).val))
+			},
+		},
+	})
+	defer ses.Close()
+
+	errCh := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		param := strconv.Itoa(i)
+		go func() {
+			errCh <- ses.Batch(func(tx *assuan.Tx) error {
+				if _, err := tx.SimpleCmd("SET", param); err != nil {
+					return err
+				}
+				data, err := tx.SimpleCmd("GET", "")
+				if err == nil && string(data) != param {
+					err = fmt.Errorf("batch interleaved: wanted %s, got %s", param, data)
+				}
+				return err
+			})
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errCh; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestInitTimeout(t *testing.T) {
+	t.Run("net.Conn", func(t *testing.T) {
+		srvConn, clConn := net.Pipe()
+		defer srvConn.Close()
+		defer clConn.Close()
+
+		if _, err := assuan.InitTimeout(clConn, 50*time.Millisecond); err != assuan.ErrGreetingTimeout {
+			t.Error("Expected ErrGreetingTimeout, got:", err)
+		}
+	})
+	t.Run("no deadlines", func(t *testing.T) {
+		srvR, _ := io.Pipe()
+		defer srvR.Close()
+
+		stream := common.ReadWriter{Reader: srvR, Writer: ioutil.Discard}
+		if _, err := assuan.InitTimeout(stream, 50*time.Millisecond); err != assuan.ErrGreetingTimeout {
+			t.Error("Expected ErrGreetingTimeout, got:", err)
+		}
+	})
+	t.Run("greeting received", func(t *testing.T) {
+		srvConn, clConn := net.Pipe()
+		defer srvConn.Close()
+		defer clConn.Close()
+		go srvConn.Write([]byte("OK hello\n"))
+
+		ses, err := assuan.InitTimeout(clConn, 5*time.Second)
+		if err != nil {
+			t.Fatal("Unexpected InitTimeout error:", err)
+		}
+		// Deadline should be reset.
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			srvConn.Write([]byte("OK\n"))
+		}()
+		if _, _, err := ses.Pipe.ReadLine(); err != nil {
+			t.Error("Unexpected error after InitTimeout:", err)
+		}
+	})
+}
+
+func TestSession_LastError(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{})
+	defer ses.Close()
+
+	if ses.LastError() != nil {
+		t.Error("LastError is set for new session")
+	}
+	if _, err := ses.SimpleCmd("FOO", ""); err == nil {
+		t.Fatal("Unknown command succeeded")
+	}
+	lastErr := ses.LastError()
+	if lastErr == nil || lastErr.Code != common.ErrAssUnknownCmd {
+		t.Fatal("Wrong LastError after failed command:", lastErr)
+	}
+	if _, err := ses.SimpleCmd("NOP", ""); err != nil {
+		t.Fatal("Unexpected SimpleCmd error:", err)
+	}
+	if ses.LastError() != nil {
+		t.Error("LastError is not reset after successful command")
+	}
+}
+
+func TestInitNoGreeting(t *testing.T) {
+	srvConn, clConn := net.Pipe()
+	go func() {
+		defer srvConn.Close()
+		server.Serve(srvConn, server.ProtoInfo{
+			SuppressGreeting: true,
+			GetDefaultState:  func() interface{} { return nil },
+		})
+	}()
+
+	ses := assuan.InitNoGreeting(clConn)
+	defer ses.Close()
+	if _, err := ses.SimpleCmd("NOP", ""); err != nil {
+		t.Error("Unexpected SimpleCmd error:", err)
+	}
+}
+
+func TestNewSession(t *testing.T) {
+	srvResp := "OK Pleased to meet you\nINQUIRE DATA\nOK\n"
+	clReq := bytes.Buffer{}
+	pipe := common.New(common.ReadWriter{Reader: strings.NewReader(srvResp), Writer: &clReq})
+	pipe.DataChunkSize = 4
+
+	ses, err := assuan.NewSession(&pipe)
+	if err != nil {
+		t.Fatal("Unexpected NewSession error:", err)
+	}
+	if _, err := ses.Transact("SETDATA", "", map[string]interface{}{"DATA": []byte("0123456789")}); err != nil {
+		t.Fatal("Unexpected Transact error:", err)
+	}
+	if clReq.String() != "SETDATA\nD 0123\nD 4567\nD 89\nEND\n" {
+		t.Errorf("Wrong request sent: %q", clReq.String())
+	}
+}
+
+func TestSession_UnexpectedLines(t *testing.T) {
+	t.Run("INQUIRE in SimpleCmd", func(t *testing.T) {
+		srvResp := "OK Pleased to meet you\nINQUIRE FOO\nERR 536871187 Cancelled <User defined source 1>\n"
+		clReq := bytes.Buffer{}
+		ses, err := assuan.Init(common.ReadWriter{Reader: strings.NewReader(srvResp), Writer: &clReq})
+		if err != nil {
+			t.Fatal("Unexpected error on client.Init:", err)
+		}
+
+		_, err = ses.SimpleCmd("TESTCMD", "")
+		if !errors.Is(err, assuan.ErrProtocol) || !strings.Contains(err.Error(), "INQUIRE FOO") {
+			t.Error("Expected ErrProtocol with offending line, got:", err)
+		}
+		if clReq.String() != "TESTCMD\nCAN\n" {
+			t.Errorf("Inquiry is not cancelled: %q", clReq.String())
+		}
+	})
+
+	for _, c := range []struct {
+		name string
+		cmd  func(ses *assuan.Session) error
+	}{
+		{"SimpleCmd", func(ses *assuan.Session) error {
+			_, err := ses.SimpleCmd("TESTCMD", "")
+			return err
+		}},
+		{"Transact", func(ses *assuan.Session) error {
+			_, err := ses.Transact("TESTCMD", "", nil)
+			return err
+		}},
+		{"Stream", func(ses *assuan.Session) error {
+			it, err := ses.Stream("TESTCMD", "")
+			if err != nil {
+				return err
+			}
+			return it.Close()
+		}},
+	} {
+		c := c
+		t.Run("unknown line in "+c.name, func(t *testing.T) {
+			srvResp := "OK Pleased to meet you\nD ABC\nBLAH blah\nOK\n"
+			ses, err := assuan.Init(common.ReadWriter{Reader: strings.NewReader(srvResp), Writer: &bytes.Buffer{}})
+			if err != nil {
+				t.Fatal("Unexpected error on client.Init:", err)
+			}
+
+			err = c.cmd(ses)
+			if !errors.Is(err, assuan.ErrProtocol) || !strings.Contains(err.Error(), "BLAH blah") {
+				t.Error("Expected ErrProtocol with offending line, got:", err)
+			}
+		})
+	}
+}
+
+func TestSession_Help(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"FOO": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) { return nil, nil },
+		},
+		Help: map[string][]string{
+			"FOO": {"FOO <bar>", "", "Does 100% of foo."},
+		},
+	})
+	defer ses.Close()
+
+	cmds, err := ses.Help()
+	if err != nil {
+		t.Fatal("Unexpected Help error:", err)
+	}
+	found := false
+	for _, cmd := range cmds {
+		if cmd == "FOO" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("FOO is missing from commands list:", cmds)
+	}
+
+	help, err := ses.HelpFor("FOO")
+	if err != nil {
+		t.Fatal("Unexpected HelpFor error:", err)
+	}
+	if !reflect.DeepEqual(help, []string{"FOO <bar>", "", "Does 100% of foo."}) {
+		t.Errorf("Wrong help text: %q", help)
+	}
+
+	if _, err := ses.HelpFor("BAR"); err == nil {
+		t.Error("No error for unknown command")
+	}
+}
+
+func TestSession_CommentCallback(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{
+		Help: map[string][]string{"NOP": {"NOP", "", "Does nothing."}},
+	})
+	defer ses.Close()
+
+	var comments []string
+	ses.SetCommentCallback(func(text string) {
+		comments = append(comments, text)
+	})
+
+	if _, err := ses.SimpleCmd("HELP", "NOP"); err != nil {
+		t.Fatal("Unexpected SimpleCmd error:", err)
+	}
+	if !reflect.DeepEqual(comments, []string{"NOP", "", "Does nothing."}) {
+		t.Errorf("Wrong comments received: %q", comments)
+	}
+}
+
+func TestSession_StatusCallback(t *testing.T) {
+	srvResp := "OK Pleased to meet you\n" +
+		"S PROGRESS need_entropy X 30 120\nD AB\nS KEYINFO key%20info\nD CD\nOK\n" +
+		"INQUIRE FOO\nS INQUIRE_MAXLEN 100\nD EF\nOK\n"
+	ses, err := assuan.Init(common.ReadWriter{Reader: strings.NewReader(srvResp), Writer: &bytes.Buffer{}})
+	if err != nil {
+		t.Fatal("Unexpected error on client.Init:", err)
+	}
+
+	var status []string
+	ses.SetStatusCallback(func(keyword, value string) {
+		status = append(status, keyword+": "+value)
+	})
+
+	data, err := ses.SimpleCmd("TESTCMD", "")
+	if err != nil {
+		t.Fatal("Unexpected error on client.SimpleCmd:", err)
+	}
+	if string(data) != "ABCD" {
+		t.Errorf("Wrong data received: %q", data)
+	}
+	data, err = ses.Transact("TESTCMD", "", map[string]interface{}{"FOO": "foo"})
+	if err != nil {
+		t.Fatal("Unexpected error on client.Transact:", err)
+	}
+	if string(data) != "EF" {
+		t.Errorf("Wrong data received: %q", data)
+	}
+
+	expected := []string{"PROGRESS: need_entropy X 30 120", "KEYINFO: key info", "INQUIRE_MAXLEN: 100"}
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("Wrong status lines received: %q", status)
+	}
+}
+
+func TestSession_LineCallback(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"GETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				pipe.WriteStatus("PROGRESS", "1")
+				pipe.WriteData([]byte("first"))
+				pipe.WriteComment("comment")
+				pipe.WriteStatus("PROGRESS", "2")
+				return nil, pipe.WriteData([]byte("second\nchunk"))
+			},
+		},
+	})
+	defer ses.Close()
+
+	var lines []assuan.RawLine
+	ses.SetLineCallback(func(line assuan.RawLine) {
+		lines = append(lines, line)
+	})
+
+	data, err := ses.SimpleCmd("GETDATA", "")
+	if err != nil {
+		t.Fatal("Unexpected SimpleCmd error:", err)
+	}
+	if string(data) != "firstsecond\nchunk" {
+		t.Errorf("Wrong data received: %q", data)
+	}
+
+	expected := []assuan.RawLine{
+		{Cmd: "S", Params: "PROGRESS 1"},
+		{Cmd: "D", Params: "first"},
+		{Cmd: "#", Params: "comment"},
+		{Cmd: "S", Params: "PROGRESS 2"},
+		{Cmd: "D", Params: "second%0Achunk"},
+		{Cmd: "OK", Params: ""},
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Wrong lines received: %q", lines)
+	}
+}
+
+func TestSession_Cancel(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"SETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				_, perr, err := server.Inquire(pipe, []string{"DATA"})
+				return perr, err
+			},
+		},
+	})
+	defer ses.Close()
+
+	if err := ses.Cancel(); err != assuan.ErrNoInquiry {
+		t.Error("Expected ErrNoInquiry, got:", err)
+	}
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := ses.Transact("SETDATA", "", map[string]interface{}{"DATA": pr})
+		errCh <- err
+	}()
+
+	if _, err := pw.Write([]byte("first chunk")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ses.Cancel(); err != nil {
+		t.Fatal("Unexpected Cancel error:", err)
+	}
+	// Unblock read if it is already pending, otherwise chunk is not
+	// consumed at all.
+	go pw.Write([]byte("second chunk"))
+
+	select {
+	case err := <-errCh:
+		perr, ok := err.(common.Error)
+		if !ok || !strings.Contains(perr.Message, "cancelled") {
+			t.Error("Expected cancellation error from server, got:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Transact is not finished after Cancel")
+	}
+
+	// Session should be in consistent state.
+	if _, err := ses.SimpleCmd("NOP", ""); err != nil {
+		t.Error("Unexpected SimpleCmd error:", err)
+	}
+}
+
+func TestSession_Raw(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"XEXPERIMENT": func(pipe *common.Pipe, _ interface{}, params string) (*common.Error, error) {
+				return nil, pipe.WriteComment("got " + params)
+			},
+		},
+	})
+	defer ses.Close()
+
+	if err := ses.WriteRaw([]byte("XEXPERIMENT foo%25\n")); err != nil {
+		t.Fatal("Unexpected WriteRaw error:", err)
+	}
+	for _, expected := range []string{"# got foo%25", "OK"} {
+		line, err := ses.ReadRawLine()
+		if err != nil {
+			t.Fatal("Unexpected ReadRawLine error:", err)
+		}
+		if line != expected {
+			t.Errorf("Line mismatch: wanted %q, got %q", expected, line)
+		}
+	}
+
+	// Session should be in consistent state.
+	if _, err := ses.SimpleCmd("NOP", ""); err != nil {
+		t.Error("Unexpected SimpleCmd error:", err)
+	}
+}
+
+func TestSession_MaxResponseSize(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"GETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				for i := 0; i < 3; i++ {
+					if err := pipe.WriteData([]byte("0123456789")); err != nil {
+						return nil, err
+					}
+				}
+				return nil, nil
+			},
+			"SETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				if _, perr, err := server.Inquire(pipe, []string{"DATA"}); perr != nil || err != nil {
+					return perr, err
+				}
+				return nil, pipe.WriteData(bytes.Repeat([]byte("x"), 40))
+			},
+		},
+	})
+	defer ses.Close()
+
+	ses.MaxResponseSize = 30
+	data, err := ses.SimpleCmd("GETDATA", "")
+	if err != nil {
+		t.Fatal("Unexpected SimpleCmd error:", err)
+	}
+	if len(data) != 30 {
+		t.Errorf("Wrong data length: %d", len(data))
+	}
+	if ses.BufferedBytes() != 0 {
+		t.Error("Buffered bytes not released after command:", ses.BufferedBytes())
+	}
+	if ses.PeakBufferedBytes() != 30 {
+		t.Error("Wrong peak buffered bytes:", ses.PeakBufferedBytes())
+	}
+
+	ses.MaxResponseSize = 25
+	if _, err := ses.SimpleCmd("GETDATA", ""); err != assuan.ErrResponseTooLarge {
+		t.Error("Expected ErrResponseTooLarge, got:", err)
+	}
+	if _, err := ses.Transact("SETDATA", "", map[string]interface{}{"DATA": []byte("foo")}); err != assuan.ErrResponseTooLarge {
+		t.Error("Expected ErrResponseTooLarge, got:", err)
+	}
+	if ses.PeakBufferedBytes() != 30 {
+		t.Error("Peak buffered bytes exceed limit:", ses.PeakBufferedBytes())
+	}
+
+	// Session should be in consistent state.
+	if _, err := ses.SimpleCmd("NOP", ""); err != nil {
+		t.Error("Unexpected SimpleCmd error:", err)
+	}
+}
+
+func TestSession_SetLineLength(t *testing.T) {
+	var lineLens []int
+	ses := startTestServer(t, server.ProtoInfo{
+		EnableEcho:           true,
+		MaxNegotiatedLineLen: 16 * 1024,
+	})
+	defer ses.Close()
+	ses.SetLineCallback(func(line assuan.RawLine) {
+		lineLens = append(lineLens, len(line.Cmd)+len(line.Params)+2)
+	})
+
+	payload := strings.Repeat("a", 5000)
+	if _, err := ses.SimpleCmd("ECHO", payload); err != common.ErrCmdTooLong {
+		t.Fatal("Expected ErrCmdTooLong before negotiation, got:", err)
+	}
+
+	if err := ses.SetLineLength(100 * 1024); err == nil {
+		t.Error("Line length over server's limit accepted")
+	}
+	if err := ses.SetLineLength(8 * 1024); err != nil {
+		t.Fatal("Unexpected SetLineLength error:", err)
+	}
+
+	lineLens = nil
+	data, err := ses.SimpleCmd("ECHO", payload)
+	if err != nil {
+		t.Fatal("Unexpected SimpleCmd error:", err)
+	}
+	if string(data) != payload {
+		t.Error("Echoed data mismatch")
+	}
+	// Server should use bigger lines too.
+	if len(lineLens) != 2 || lineLens[0] != len("D ")+len(payload)+1 {
+		t.Errorf("Unexpected response line lengths: %v", lineLens)
+	}
+}
@@ -0,0 +1,212 @@
+package client
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/foxcpp/go-assuan/common"
+)
+
+// Line is a single line of server's response returned by LineIter.
+type Line struct {
+	// "D" for data and "S" for status lines.
+	Type string
+	// Unescaped data, set only for D lines.
+	Data []byte
+	// Keyword and unescaped value, set only for S lines.
+	Keyword string
+	Value   string
+}
+
+// LineIter reads server's response line by line, see Session.Stream.
+type LineIter struct {
+	ses  *Session
+	dec  dataDecoder
+	done bool
+	err  error
+	// Set if too long line was skipped, returned instead of io.EOF or
+	// server's error.
+	longErr error
+}
+
+// Stream sends command with specified parameters and returns iterator over
+// lines of server's response. This allows to process large responses
+// incrementally, server is not read faster than Next is called.
+//
+// Session is locked until response is read completely (Next returned
+// error) or iterator is closed, so LineIter must be always drained or
+// closed.
+//
+// Inquiries are not supported, CAN is sent in response to them.
+func (ses *Session) Stream(cmd string, params string) (*LineIter, error) {
+	if err := ses.lock(); err != nil {
+		return nil, err
+	}
+
+	Logger.Println("Sending command (streaming):", cmd, params)
+	if err := ses.Pipe.WriteLine(cmd, params); err != nil {
+		Logger.Println("... I/O error:", err)
+		ses.unlock()
+		return nil, err
+	}
+	return &LineIter{ses: ses}, nil
+}
+
+// Next returns next data or status line of response. Lines are returned in
+// the same order as they were received. Escape sequence split between D
+// lines is returned as a part of the line where it ends.
+//
+// io.EOF is returned after OK. Error sent by server is returned as
+// common.Error. Once Next returned error, subsequent calls return same
+// error.
+//
+// Lines longer than line length limit are skipped, *common.LineTooLongError
+// is returned instead of io.EOF or server's error at the end of response.
+func (it *LineIter) Next() (Line, error) {
+	if it.done {
+		return Line{}, it.err
+	}
+
+	for {
+		scmd, sparams, err := it.ses.readLineRaw()
+		if err != nil {
+			lerr, err := it.ses.skipLongLine(err)
+			if err == nil {
+				if it.longErr == nil {
+					it.longErr = lerr
+				}
+				continue
+			}
+			Logger.Println("... I/O error:", err)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return Line{}, it.finish(err)
+		}
+
+		switch scmd {
+		case "OK":
+			it.ses.setLastError(nil)
+			if err := it.ses.checkTrailing(); err != nil {
+				return Line{}, it.finish(err)
+			}
+			if it.longErr != nil {
+				return Line{}, it.finish(it.longErr)
+			}
+			if err := it.dec.finish(); err != nil {
+				return Line{}, it.finish(err)
+			}
+			return Line{}, it.finish(io.EOF)
+		case "ERR":
+			sparams, err := common.Unescape(sparams)
+			if err != nil {
+				return Line{}, it.finish(err)
+			}
+			Logger.Println("... Received ERR: ", sparams)
+			cmdErr := it.ses.decodeErr(sparams)
+			if it.longErr != nil {
+				return Line{}, it.finish(it.longErr)
+			}
+			return Line{}, it.finish(cmdErr)
+		case "D":
+			data, err := it.dec.decode(sparams)
+			if err != nil {
+				return Line{}, it.finish(err)
+			}
+			if data == "" {
+				// Whole line is a part of escape sequence continued in
+				// the next one.
+				continue
+			}
+			return Line{Type: "D", Data: []byte(data)}, nil
+		case "S":
+			keyword, value, err := common.ParseStatus(sparams)
+			if err != nil {
+				return Line{}, it.finish(err)
+			}
+			return Line{Type: "S", Keyword: keyword, Value: value}, nil
+		case "INQUIRE":
+			Logger.Println("... unexpected inquiry:", sparams)
+			if err := it.ses.Pipe.WriteLine("CAN", ""); err != nil {
+				return Line{}, it.finish(err)
+			}
+		case "#":
+		default:
+			return Line{}, it.finish(unexpectedLine(scmd, sparams))
+		}
+	}
+}
+
+// Close reads and discards rest of response and unlocks session.
+//
+// Returned error is the one that terminated response (nil for OK).
+func (it *LineIter) Close() error {
+	for !it.done {
+		it.Next()
+	}
+	if it.err == io.EOF {
+		return nil
+	}
+	return it.err
+}
+
+func (it *LineIter) finish(err error) error {
+	it.done = true
+	it.err = err
+	it.ses.unlock()
+	return err
+}
+
+// SplitKeyword splits data segment at first space into keyword and value,
+// it is the default key extraction function for CollectData. Segments
+// without space are treated as keyword with empty value.
+func SplitKeyword(segment []byte) (key string, value []byte, ok bool) {
+	if i := bytes.IndexByte(segment, ' '); i != -1 {
+		return string(segment[:i]), segment[i+1:], true
+	}
+	return string(segment), []byte{}, len(segment) != 0
+}
+
+// CollectData sends command and collects items of response into map, for
+// protocols that send several named items in response to single command
+// (i.e. scdaemon's GETATTR and LEARN).
+//
+// Each data (D) line and each status (S) line (as "KEYWORD value") is
+// passed to split that extracts key and value from it, segments for which
+// split returns false are skipped. If split is nil, SplitKeyword is used.
+// Values of segments with same key are concatenated.
+//
+// Note that servers may split data arbitrarily between D lines, so this
+// works only for protocols that send each item in separate line.
+func (ses *Session) CollectData(cmd, params string, split func(segment []byte) (key string, value []byte, ok bool)) (map[string][]byte, error) {
+	if split == nil {
+		split = SplitKeyword
+	}
+
+	it, err := ses.Stream(cmd, params)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	res := make(map[string][]byte)
+	for {
+		line, err := it.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		segment := line.Data
+		if line.Type == "S" {
+			segment = []byte(line.Keyword + " " + line.Value)
+		}
+		key, value, ok := split(segment)
+		if !ok {
+			continue
+		}
+		res[key] = append(res[key], value...)
+	}
+}
@@ -0,0 +1,222 @@
+package client_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	assuan "github.com/foxcpp/go-assuan/client"
+	"github.com/foxcpp/go-assuan/common"
+	"github.com/foxcpp/go-assuan/server"
+)
+
+func TestSession_Stream(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"LIST": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				if err := pipe.WriteData([]byte("first%\n")); err != nil {
+					return nil, err
+				}
+				if err := pipe.WriteStatus("PROGRESS", "list 1 2"); err != nil {
+					return nil, err
+				}
+				if err := pipe.WriteData([]byte("second")); err != nil {
+					return nil, err
+				}
+				return nil, pipe.WriteStatus("TRUNCATED", "")
+			},
+			"SPLIT": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return nil, pipe.WriteRaw([]byte("D 10%2\nD 5 %\nD 0A\n"))
+			},
+			"FAIL": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				if err := pipe.WriteData([]byte("partial")); err != nil {
+					return nil, err
+				}
+				return common.NewAssuanError(common.ErrAssGeneral, "failed"), nil
+			},
+		},
+	})
+	defer ses.Close()
+
+	t.Run("OK", func(t *testing.T) {
+		it, err := ses.Stream("LIST", "")
+		if err != nil {
+			t.Fatal("Unexpected Stream error:", err)
+		}
+
+		var lines []assuan.Line
+		for {
+			line, err := it.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal("Unexpected Next error:", err)
+			}
+			lines = append(lines, line)
+		}
+
+		expected := []assuan.Line{
+			{Type: "D", Data: []byte("first%\n")},
+			{Type: "S", Keyword: "PROGRESS", Value: "list 1 2"},
+			{Type: "D", Data: []byte("second")},
+			{Type: "S", Keyword: "TRUNCATED"},
+		}
+		if !reflect.DeepEqual(lines, expected) {
+			t.Errorf("Wrong lines received: %+v", lines)
+		}
+		if err := it.Close(); err != nil {
+			t.Error("Unexpected Close error:", err)
+		}
+	})
+	t.Run("split escape", func(t *testing.T) {
+		it, err := ses.Stream("SPLIT", "")
+		if err != nil {
+			t.Fatal("Unexpected Stream error:", err)
+		}
+		var data []byte
+		for {
+			line, err := it.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal("Unexpected Next error:", err)
+			}
+			data = append(data, line.Data...)
+		}
+		if string(data) != "10% \n" {
+			t.Errorf("Wrong data received: %q", data)
+		}
+	})
+	t.Run("ERR", func(t *testing.T) {
+		it, err := ses.Stream("FAIL", "")
+		if err != nil {
+			t.Fatal("Unexpected Stream error:", err)
+		}
+		if _, err := it.Next(); err != nil {
+			t.Fatal("Unexpected Next error:", err)
+		}
+		if _, err := it.Next(); err == nil || err == io.EOF {
+			t.Fatal("Expected server error, got:", err)
+		}
+	})
+	t.Run("Close drains response", func(t *testing.T) {
+		it, err := ses.Stream("LIST", "")
+		if err != nil {
+			t.Fatal("Unexpected Stream error:", err)
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal("Unexpected Close error:", err)
+		}
+
+		// Session should be usable again.
+		if _, err := ses.SimpleCmd("NOP", ""); err != nil {
+			t.Error("Unexpected SimpleCmd error:", err)
+		}
+	})
+}
+
+func TestSession_StreamLiveStatus(t *testing.T) {
+	ack := make(chan struct{})
+	ses := startTestServer(t, server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"SLOWOP": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				for i := 0; i < 3; i++ {
+					if err := pipe.WriteStatus("PROGRESS", strconv.Itoa(i)); err != nil {
+						return nil, err
+					}
+					// Client must see status before operation continues.
+					select {
+					case <-ack:
+					case <-time.After(5 * time.Second):
+						return nil, errors.New("status line is not delivered to client")
+					}
+				}
+				return nil, nil
+			},
+		},
+	})
+	defer ses.Close()
+
+	it, err := ses.Stream("SLOWOP", "")
+	if err != nil {
+		t.Fatal("Unexpected Stream error:", err)
+	}
+	for i := 0; i < 3; i++ {
+		line, err := it.Next()
+		if err != nil {
+			t.Fatal("Unexpected Next error:", err)
+		}
+		if line.Type != "S" || line.Value != strconv.Itoa(i) {
+			t.Fatalf("Unexpected line: %+v", line)
+		}
+		ack <- struct{}{}
+	}
+	if err := it.Close(); err != nil {
+		t.Error("Unexpected Close error:", err)
+	}
+}
+
+func TestSession_CollectData(t *testing.T) {
+	ses := startTestServer(t, server.ProtoInfo{
+		Handlers: map[string]server.CommandHandler{
+			"LEARN": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				pipe.WriteStatus("SERIALNO", "D2760001240102010006")
+				pipe.WriteStatus("DISP-NAME", "Doe<<John")
+				pipe.WriteData([]byte("PUBKEY \x00\x01"))
+				return nil, pipe.WriteData([]byte("CERT 1234"))
+			},
+			"GETATTR": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				pipe.WriteData([]byte("url=https://example.org"))
+				return nil, pipe.WriteData([]byte("junk"))
+			},
+		},
+	})
+	defer ses.Close()
+
+	t.Run("default split", func(t *testing.T) {
+		items, err := ses.CollectData("LEARN", "", nil)
+		if err != nil {
+			t.Fatal("Unexpected CollectData error:", err)
+		}
+		expected := map[string][]byte{
+			"SERIALNO":  []byte("D2760001240102010006"),
+			"DISP-NAME": []byte("Doe<<John"),
+			"PUBKEY":    []byte("\x00\x01"),
+			"CERT":      []byte("1234"),
+		}
+		if !reflect.DeepEqual(items, expected) {
+			t.Errorf("Wrong items collected: %q", items)
+		}
+	})
+	t.Run("custom split", func(t *testing.T) {
+		split := func(segment []byte) (string, []byte, bool) {
+			i := bytes.IndexByte(segment, '=')
+			if i == -1 {
+				return "", nil, false
+			}
+			return string(segment[:i]), segment[i+1:], true
+		}
+		items, err := ses.CollectData("GETATTR", "", split)
+		if err != nil {
+			t.Fatal("Unexpected CollectData error:", err)
+		}
+		if !reflect.DeepEqual(items, map[string][]byte{"url": []byte("https://example.org")}) {
+			t.Errorf("Wrong items collected: %q", items)
+		}
+	})
+	t.Run("error", func(t *testing.T) {
+		if _, err := ses.CollectData("UNKNOWN", "", nil); err == nil {
+			t.Error("Expected error for unknown command")
+		}
+		// Session should be in consistent state.
+		if _, err := ses.SimpleCmd("NOP", ""); err != nil {
+			t.Error("Unexpected SimpleCmd error:", err)
+		}
+	})
+}
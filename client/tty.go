@@ -0,0 +1,89 @@
+package client
+
+import (
+	"os"
+	"strings"
+)
+
+// TTYSettings describes terminal and locale that should be used by
+// gpg-agent (and pinentry launched by it) to interact with user.
+type TTYSettings struct {
+	TTYName    string
+	TTYType    string
+	Display    string
+	LCCtype    string
+	LCMessages string
+}
+
+// CurrentTTYSettings collects TTYSettings for current process from
+// environment the same way GnuPG tools do.
+//
+// Terminal name is taken from GPG_TTY, if it is not set then name of
+// terminal connected to stdin is used (only on Linux). Locale categories
+// are resolved using LC_ALL, LC_* and LANG variables.
+func CurrentTTYSettings() TTYSettings {
+	ttyName := os.Getenv("GPG_TTY")
+	if ttyName == "" {
+		ttyName = stdinTTYName()
+	}
+	return TTYSettings{
+		TTYName:    ttyName,
+		TTYType:    os.Getenv("TERM"),
+		Display:    os.Getenv("DISPLAY"),
+		LCCtype:    localeCategory("LC_CTYPE"),
+		LCMessages: localeCategory("LC_MESSAGES"),
+	}
+}
+
+// stdinTTYName returns path of terminal connected to stdin or empty string
+// if it can't be determined.
+func stdinTTYName() string {
+	name, err := os.Readlink("/proc/self/fd/0")
+	if err != nil || !strings.HasPrefix(name, "/dev/") || name == "/dev/null" {
+		return ""
+	}
+	return name
+}
+
+func localeCategory(category string) string {
+	for _, env := range []string{"LC_ALL", category, "LANG"} {
+		if val := os.Getenv(env); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// Apply sends OPTION command for each non-empty setting.
+func (s TTYSettings) Apply(ses *Session) error {
+	opts := []struct{ name, value string }{
+		{"ttyname", s.TTYName},
+		{"ttytype", s.TTYType},
+		{"display", s.Display},
+		{"lc-ctype", s.LCCtype},
+		{"lc-messages", s.LCMessages},
+	}
+	for _, opt := range opts {
+		if opt.value == "" {
+			continue
+		}
+		if err := ses.Option(opt.name, opt.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfigureTTY makes gpg-agent use terminal and locale of the current
+// process by applying CurrentTTYSettings and sending UPDATESTARTUPTTY.
+//
+// This is what every gpg-agent client should do after connecting so
+// prompts appear on the right terminal.
+func ConfigureTTY(ses *Session) error {
+	Logger.Println("Configuring agent TTY...")
+	if err := CurrentTTYSettings().Apply(ses); err != nil {
+		return err
+	}
+	_, err := ses.SimpleCmd("UPDATESTARTUPTTY", "")
+	return err
+}
@@ -0,0 +1,91 @@
+package client_test
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	assuan "github.com/foxcpp/go-assuan/client"
+	"github.com/foxcpp/go-assuan/common"
+	"github.com/foxcpp/go-assuan/server"
+)
+
+func setenv(t *testing.T, vars map[string]string) {
+	for k, v := range vars {
+		old, prs := os.LookupEnv(k)
+		os.Setenv(k, v)
+		k := k
+		t.Cleanup(func() {
+			if prs {
+				os.Setenv(k, old)
+			} else {
+				os.Unsetenv(k)
+			}
+		})
+	}
+}
+
+func TestCurrentTTYSettings(t *testing.T) {
+	setenv(t, map[string]string{
+		"GPG_TTY":     "/dev/pts/3",
+		"TERM":        "xterm-256color",
+		"DISPLAY":     ":0",
+		"LC_ALL":      "",
+		"LC_CTYPE":    "",
+		"LC_MESSAGES": "ru_RU.UTF-8",
+		"LANG":        "en_US.UTF-8",
+	})
+
+	expected := assuan.TTYSettings{
+		TTYName:    "/dev/pts/3",
+		TTYType:    "xterm-256color",
+		Display:    ":0",
+		LCCtype:    "en_US.UTF-8",
+		LCMessages: "ru_RU.UTF-8",
+	}
+	if s := assuan.CurrentTTYSettings(); s != expected {
+		t.Errorf("Wrong settings: %+v", s)
+	}
+}
+
+func TestConfigureTTY(t *testing.T) {
+	setenv(t, map[string]string{
+		"GPG_TTY":     "/dev/pts/3",
+		"TERM":        "xterm",
+		"DISPLAY":     "",
+		"LC_ALL":      "C",
+		"LC_CTYPE":    "",
+		"LC_MESSAGES": "",
+		"LANG":        "",
+	})
+
+	var received []string
+	ses := startTestServer(t, server.ProtoInfo{
+		SetOption: func(_ interface{}, key, val string) error {
+			received = append(received, key+"="+val)
+			return nil
+		},
+		Handlers: map[string]server.CommandHandler{
+			"UPDATESTARTUPTTY": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				received = append(received, "UPDATESTARTUPTTY")
+				return nil, nil
+			},
+		},
+	})
+	defer ses.Close()
+
+	if err := assuan.ConfigureTTY(ses); err != nil {
+		t.Fatal("Unexpected ConfigureTTY error:", err)
+	}
+
+	expected := []string{
+		"ttyname=/dev/pts/3",
+		"ttytype=xterm",
+		"lc-ctype=C",
+		"lc-messages=C",
+		"UPDATESTARTUPTTY",
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Wrong commands received: %v", received)
+	}
+}
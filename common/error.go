@@ -2,7 +2,7 @@ package common
 
 import (
 	"errors"
-	"regexp"
+	"fmt"
 	"strconv"
 	"strings"
 )
@@ -31,24 +31,66 @@ func (e Error) Error() string {
 	return e.SrcName + ": " + e.Message
 }
 
+var srcNames = map[ErrorSource]string{
+	ErrSrcUnknown:  "unknown source",
+	ErrSrcGcrypt:   "gcrypt",
+	ErrSrcGPG:      "gpg",
+	ErrSrcGPGSM:    "gpgsm",
+	ErrSrcGPGagent: "gpg-agent",
+	ErrSrcPinentry: "pinentry",
+	ErrSrcSCD:      "scd",
+	ErrSrcGPGME:    "gpgme",
+	ErrSrcKeybox:   "keybox",
+	ErrSrcKSBA:     "ksba",
+	ErrSrcDirmngr:  "dirmngr",
+	ErrSrcGSTA:     "gsti",
+	ErrSrcGPA:      "gpa",
+	ErrSrcKleo:     "kleopatra",
+	ErrSrcG13:      "g13",
+	ErrSrcAssuan:   "assuan",
+	ErrSrcTLS:      "tls",
+	ErrSrcAny:      "any source",
+	ErrSrcUser1:    "user defined source 1",
+	ErrSrcUser2:    "user defined source 2",
+	ErrSrcUser3:    "user defined source 3",
+	ErrSrcUser4:    "user defined source 4",
+}
+
+// NewError creates protocol error with specified source, code and message.
+// SrcName is filled based on source.
+func NewError(src ErrorSource, code ErrorCode, msg string) *Error {
+	name, ok := srcNames[src]
+	if !ok {
+		name = "unknown source"
+	}
+	return &Error{Src: src, Code: code, SrcName: name, Message: msg}
+}
+
+// Errorf is same as NewError but formats message using fmt.Sprintf.
+func Errorf(src ErrorSource, code ErrorCode, format string, args ...interface{}) *Error {
+	return NewError(src, code, fmt.Sprintf(format, args...))
+}
+
+// NewAssuanError creates protocol error with Assuan as a source.
+func NewAssuanError(code ErrorCode, msg string) *Error {
+	return NewError(ErrSrcAssuan, code, msg)
+}
+
+// NewPinentryError creates protocol error with pinentry as a source.
+func NewPinentryError(code ErrorCode, msg string) *Error {
+	return NewError(ErrSrcPinentry, code, msg)
+}
+
 // WriteError converts arbitrary error object to protocol error with Assuan Write Error code.
 func WriteError(err error) *Error {
-	return &Error{
-		Src: ErrSrcAssuan, Code: ErrAssWriteError,
-		SrcName: "assuan", Message: err.Error(),
-	}
+	return NewAssuanError(ErrAssWriteError, err.Error())
 }
 
 // WriteError converts arbitrary error object to protocol error with Assuan Read Error code.
 func ReadError(err error) *Error {
-	return &Error{
-		Src: ErrSrcAssuan, Code: ErrAssReadError,
-		SrcName: "assuan", Message: err.Error(),
-	}
+	return NewAssuanError(ErrAssReadError, err.Error())
 }
 
-var errParamsRegex = regexp.MustCompile(`^(\d{1,10}) ([\w ]+)(?:<([\w ]+)>)?$`)
-
 func mapSource(src string) string {
 	// Used for protocol-level errors
 	if strings.ToLower(src) == "user defined source 1" {
@@ -62,28 +104,64 @@ func DecodeErrCmd(params string) error {
 	//  ERR CODE      Description         <Source name>
 	//  ERR 536871187 Unknown IPC command <User defined source 1>
 	//
+	// Description and source are optional, libassuan may also append
+	// comment set by server after source:
+	//  ERR 67108922 No data <GPG Agent> - no passphrase given
+	//
 	// Where CODE consists of source code and error code and few reserved bits:
 	//  1000000 0000000 0000000100010011
 	//  SOURCE  RESRVD  CODE
 
-	// Parse parameters string.
-	groups := errParamsRegex.FindStringSubmatch(params)
-	if groups == nil {
-		return errors.New("malformed ERR arguments")
+	codeStr, rest := params, ""
+	if i := strings.IndexByte(params, ' '); i != -1 {
+		codeStr, rest = params[:i], params[i+1:]
 	}
-	codeStr, desc := groups[1], strings.TrimSpace(groups[2])
-	src := "unknown source"
-	if len(groups) == 4 {
-		src = mapSource(groups[3])
+	if len(codeStr) == 0 || len(codeStr) > 10 {
+		return errors.New("malformed ERR arguments")
 	}
-	code, err := strconv.Atoi(codeStr)
+	code, err := strconv.ParseUint(codeStr, 10, 32)
 	if err != nil {
 		return errors.New("malformed ERR arguments (code)")
 	}
+	srcCode, errCode := SplitErrCode(int(code))
+
+	desc, src, comment := splitErrDesc(rest)
+	if src == "" {
+		src = "unknown source"
+		if name, ok := srcNames[srcCode]; ok {
+			src = name
+		}
+	}
+	if comment != "" {
+		if desc != "" {
+			desc += " - "
+		}
+		desc += comment
+	}
+
+	return Error{Src: srcCode, Code: errCode, SrcName: mapSource(src), Message: desc}
+}
 
-	srcCode, errCode := SplitErrCode(code)
+// splitErrDesc splits part of ERR parameters after code into description,
+// source name (without angle brackets) and comment.
+func splitErrDesc(s string) (desc, src, comment string) {
+	s = strings.TrimSpace(s)
+	start := strings.LastIndexByte(s, '<')
+	if start == -1 {
+		return s, "", ""
+	}
+	end := strings.IndexByte(s[start:], '>')
+	if end == -1 {
+		return s, "", ""
+	}
+	end += start
 
-	return Error{Src: srcCode, Code: errCode, SrcName: src, Message: desc}
+	after := strings.TrimSpace(s[end+1:])
+	if after != "" && !strings.HasPrefix(after, "-") {
+		// Not a source, just angle brackets in description.
+		return s, "", ""
+	}
+	return strings.TrimSpace(s[:start]), s[start+1 : end], strings.TrimSpace(strings.TrimPrefix(after, "-"))
 }
 
 func SplitErrCode(code int) (ErrorSource, ErrorCode) {
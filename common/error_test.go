@@ -41,3 +41,75 @@ func TestDecodeErrCmd(t *testing.T) {
 		t.Errorf("Error message mismatch: wanted '%s', got '%s'", "Unknown IPC command", err.Message)
 	}
 }
+
+func TestDecodeErrCmd_SourceWithDash(t *testing.T) {
+	errI := common.DecodeErrCmd("67108891 Not found <gpg-agent>")
+	err, ok := errI.(common.Error)
+	if !ok {
+		t.Fatal("Non-common.Error error returned:", errI)
+	}
+	if err.Src != common.ErrSrcGPGagent || err.Code != common.ErrNotFound {
+		t.Errorf("Wrong error decoded: %+v", err)
+	}
+}
+
+func TestDecodeErrCmd_RealLines(t *testing.T) {
+	cases := []struct {
+		params  string
+		src     common.ErrorSource
+		code    common.ErrorCode
+		srcName string
+		message string
+	}{
+		{"67108933 Not implemented <GPG Agent>", common.ErrSrcGPGagent, common.ErrNotImplemented, "GPG Agent", "Not implemented"},
+		{"83886179 Operation cancelled <Pinentry>", common.ErrSrcPinentry, common.ErrCanceled, "Pinentry", "Operation cancelled"},
+		{"67108922 No data <GPG Agent> - no passphrase given", common.ErrSrcGPGagent, common.ErrNoData, "GPG Agent", "No data - no passphrase given"},
+		{"100663404 Card error: bad PIN (try again) <SCD>", common.ErrSrcSCD, common.ErrCard, "SCD", "Card error: bad PIN (try again)"},
+		{"67108933 Not implemented", common.ErrSrcGPGagent, common.ErrNotImplemented, "gpg-agent", "Not implemented"},
+		{"67108933", common.ErrSrcGPGagent, common.ErrNotImplemented, "gpg-agent", ""},
+		{"536870913 a <b> c", common.ErrSrcUser1, 1, "Assuan", "a <b> c"},
+	}
+	for _, c := range cases {
+		t.Run(c.params, func(t *testing.T) {
+			errI := common.DecodeErrCmd(c.params)
+			err, ok := errI.(common.Error)
+			if !ok {
+				t.Fatal("Non-common.Error error returned:", errI)
+			}
+			if err.Src != c.src || err.Code != c.code || err.SrcName != c.srcName || err.Message != c.message {
+				t.Errorf("Wrong error decoded: %+v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeErrCmd_Malformed(t *testing.T) {
+	for _, params := range []string{"", "foo bar", "12345678901 too big code", "-1 negative"} {
+		if _, ok := common.DecodeErrCmd(params).(common.Error); ok {
+			t.Errorf("Malformed ERR parameters accepted: '%s'", params)
+		}
+	}
+}
+
+func TestNewError(t *testing.T) {
+	err := common.NewAssuanError(common.ErrAssUnknownCmd, "unknown IPC command")
+	if err.Src != common.ErrSrcAssuan || err.SrcName != "assuan" {
+		t.Errorf("Error source mismatch: wanted %d (assuan), got %d (%s)", common.ErrSrcAssuan, err.Src, err.SrcName)
+	}
+	if err.Code != common.ErrAssUnknownCmd {
+		t.Errorf("Error code mismatch: wanted %d, got %d", common.ErrAssUnknownCmd, err.Code)
+	}
+
+	err = common.NewPinentryError(common.ErrCanceled, "operation canceled")
+	if err.Src != common.ErrSrcPinentry || err.SrcName != "pinentry" {
+		t.Errorf("Error source mismatch: wanted %d (pinentry), got %d (%s)", common.ErrSrcPinentry, err.Src, err.SrcName)
+	}
+
+	err = common.Errorf(common.ErrSrcGPGagent, common.ErrNotFound, "key %s not found", "ABCDEF")
+	if err.SrcName != "gpg-agent" {
+		t.Errorf("Error source name mismatch: wanted %s, got %s", "gpg-agent", err.SrcName)
+	}
+	if err.Message != "key ABCDEF not found" {
+		t.Errorf("Error message mismatch: wanted '%s', got '%s'", "key ABCDEF not found", err.Message)
+	}
+}
@@ -5,7 +5,15 @@ import (
 	"strings"
 )
 
-var escaper = strings.NewReplacer("\r", "%0D", "\n", "%0A", "%", "%25", "\\", "%5C")
+const hexDigits = "0123456789ABCDEF"
+
+// escapedChars is a set of bytes that should be percent-encoded in
+// parameters.
+var escapedChars = [256]bool{'\r': true, '\n': true, '%': true, '\\': true}
+
+// dataEscapedChars is a set of bytes that should be percent-encoded in
+// D lines.
+var dataEscapedChars = [256]bool{'\r': true, '\n': true, '%': true}
 
 /*
 Percent-encode CR, LF, % and backslash at end as required by protocol.
@@ -15,7 +23,45 @@ We escape all backslashes to keep code simple.
 Ref.: https//www.gnupg.org/documentation/manuals/assuan/Client-requests.html
 */
 func escapeParameters(raw string) string {
-	return escaper.Replace(raw)
+	return escapeSet(raw, &escapedChars)
+}
+
+// escapeData percent-encodes only CR, LF and %, which is enough for data
+// sent in D lines. All other bytes (including backslash and non-ASCII
+// ones) are sent as is.
+func escapeData(raw string) string {
+	return escapeSet(raw, &dataEscapedChars)
+}
+
+func escapeSet(raw string, set *[256]bool) string {
+	special := 0
+	for i := 0; i < len(raw); i++ {
+		if set[raw[i]] {
+			special++
+		}
+	}
+
+	// Most parameters contain nothing to escape, avoid allocation for them.
+	if special == 0 {
+		return raw
+	}
+
+	// Each escaped byte takes 3 bytes of output.
+	buf := make([]byte, len(raw)+2*special)
+	j := 0
+	for i := 0; i < len(raw); i++ {
+		b := raw[i]
+		if !set[b] {
+			buf[j] = b
+			j++
+			continue
+		}
+		buf[j] = '%'
+		buf[j+1] = hexDigits[b>>4]
+		buf[j+2] = hexDigits[b&0xF]
+		j += 3
+	}
+	return string(buf)
 }
 
 /*
@@ -27,7 +73,19 @@ backslashes.
 Ref.: https//www.gnupg.org/documentation/manuals/assuan/Client-requests.html
 */
 func unescapeParameters(encoded string) (string, error) {
+	// Fast path for the common case, url.PathUnescape is much slower at
+	// scanning the string.
+	if strings.IndexByte(encoded, '%') < 0 {
+		return encoded, nil
+	}
+
 	// Percent-encoding used in Assuan is same as percent-encoding used in
 	// path part of URL.
 	return url.PathUnescape(encoded)
 }
+
+// Unescape decodes percent-encoded parameters as returned by
+// Pipe.ReadLineRaw.
+func Unescape(params string) (string, error) {
+	return unescapeParameters(params)
+}
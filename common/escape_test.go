@@ -1,6 +1,11 @@
 package common
 
-import "testing"
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
 
 func TestEscapeParams(t *testing.T) {
 	if escapeParameters("\r\n%") != "%0D%0A%25" {
@@ -11,6 +16,48 @@ func TestEscapeParams(t *testing.T) {
 	}
 }
 
+func TestEscapeData(t *testing.T) {
+	raw := make([]byte, 256)
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+
+	escaped := escapeData(string(raw))
+	// Only CR, LF and % are expanded, by 2 bytes each.
+	if len(escaped) != len(raw)+3*2 {
+		t.Errorf("Wrong escaped length: %d", len(escaped))
+	}
+	if !strings.Contains(escaped, "[\\]") || !strings.Contains(escaped, "\xFE\xFF") {
+		t.Error("Backslash or high bytes are escaped:", escaped)
+	}
+	res, err := unescapeParameters(escaped)
+	if err != nil {
+		t.Fatal("unescape:", err)
+	}
+	if res != string(raw) {
+		t.Error("Round-trip mismatch:", res)
+	}
+}
+
+func TestEscapeParams_AllBytes(t *testing.T) {
+	raw := make([]byte, 256)
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+
+	escaped := escapeParameters(string(raw))
+	if strings.ContainsAny(escaped, "\r\n\\") {
+		t.Error("Escaped string contains CR, LF or backslash:", escaped)
+	}
+	res, err := unescapeParameters(escaped)
+	if err != nil {
+		t.Fatal("unescape:", err)
+	}
+	if res != string(raw) {
+		t.Error("Round-trip mismatch:", res)
+	}
+}
+
 func TestUnescapeParams(t *testing.T) {
 	res, err := unescapeParameters("%0D%0A%25%5C")
 	if err != nil {
@@ -31,3 +78,42 @@ func TestUnescapeParams(t *testing.T) {
 		t.Error("common.unescapeParameters removes + from output")
 	}
 }
+
+func BenchmarkEscapeParams(b *testing.B) {
+	// 1 MiB of text with special characters here and there.
+	raw := string(bytes.Repeat([]byte("line of text with 100% of \\ chars\r\n"), 1<<20/37))
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		escapeParameters(raw)
+	}
+}
+
+func BenchmarkEscapeParams_NoSpecial(b *testing.B) {
+	for _, size := range []int{64, 1 << 20} {
+		raw := strings.Repeat("a", size)
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.SetBytes(int64(len(raw)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				escapeParameters(raw)
+			}
+		})
+	}
+}
+
+func BenchmarkUnescapeParams_NoSpecial(b *testing.B) {
+	for _, size := range []int{64, 1 << 20} {
+		raw := strings.Repeat("a", size)
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.SetBytes(int64(len(raw)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := unescapeParameters(raw); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -2,18 +2,34 @@ package common
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"regexp"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
 	// MaxLineLen is a maximum length of line in Assuan protocol, including
 	// space after command and LF.
 	MaxLineLen = 1000
+
+	// MinLineLen is a smallest line length limit accepted by
+	// Pipe.SetMaxLineLen: "D ", one escape sequence (%XX) and LF.
+	MinLineLen = 6
 )
 
+// ErrCmdTooLong is returned by WriteLine if command together with escaped
+// parameters doesn't fit into line length limit (MaxLineLen by default).
+var ErrCmdTooLong = errors.New("too long command or parameters")
+
+// ErrInvalidLineLen is returned by SetMaxLineLen if requested limit is
+// smaller than MinLineLen.
+var ErrInvalidLineLen = errors.New("line length limit is too small")
+
 // ReadWriter ties arbitrary io.Reader and io.Writer to get a struct that
 // satisfies io.ReadWriter requirements.
 type ReadWriter struct {
@@ -23,21 +39,42 @@ type ReadWriter struct {
 
 // Pipe is a wrapper for Assuan command stream.
 type Pipe struct {
-	scnr *bufio.Scanner
-	r    io.Reader
-	w    io.Writer
+	// MaxDataSize limits amount of data accepted by ReadData, in bytes.
+	// Zero means no limit.
+	MaxDataSize int
+	// CaseSensitive disables conversion of command names to upper case on
+	// read and write.
+	//
+	// Assuan commands are case-insensitive and peers are free to send them in
+	// any case, so enabling this is only useful for derived protocols with
+	// case-sensitive keywords. Built-in commands and responses (OK, ERR, D,
+	// END, etc) will not be recognized if peer sends them in lower case.
+	CaseSensitive bool
+	// DataChunkSize controls maximum length of (escaped) data sent in one D
+	// line by WriteData and WriteDataReader. Smaller chunks reduce latency
+	// of streaming, larger ones reduce overhead. Zero means maximum size
+	// allowed by line length limit (MaxLineLen - 3).
+	DataChunkSize int
+
+	rd         *bufio.Reader
+	maxLineLen int
+	// Limit for lines written by pipe.
+	outLineLen int
+	// Line returned by Peek, valid if hasPeeked is set.
+	peeked    string
+	hasPeeked bool
+	r         io.Reader
+	w         io.Writer
+	// Buffers D lines, flushed by every other written line.
+	wr *bufio.Writer
 }
 
 func New(stream io.ReadWriter) Pipe {
-	p := Pipe{bufio.NewScanner(stream), stream, stream}
-	p.scnr.Buffer(make([]byte, 0, MaxLineLen), MaxLineLen)
-	return p
+	return Pipe{rd: bufio.NewReader(stream), maxLineLen: MaxLineLen, outLineLen: MaxLineLen, r: stream, w: stream, wr: bufio.NewWriterSize(stream, dataWriteBufSize)}
 }
 
 func NewPipe(in io.Reader, out io.Writer) Pipe {
-	p := Pipe{bufio.NewScanner(in), in, out}
-	p.scnr.Buffer(make([]byte, 0, MaxLineLen), MaxLineLen)
-	return p
+	return Pipe{rd: bufio.NewReader(in), maxLineLen: MaxLineLen, outLineLen: MaxLineLen, r: in, w: out, wr: bufio.NewWriterSize(out, dataWriteBufSize)}
 }
 
 func (p *Pipe) Close() error {
@@ -52,130 +89,405 @@ func (p *Pipe) Close() error {
 //
 // Note that even with b=false line length will be restricted to
 // bufio.MaxScanTokenSize (64 KiB).
-//
-// This function MUST be called before any I/O, otherwise it will panic.
 func (p *Pipe) RestrictInputLen(restrict bool) {
 	if restrict {
-		p.scnr.Buffer(make([]byte, 0, MaxLineLen), MaxLineLen)
+		p.maxLineLen = MaxLineLen
 	} else {
-		p.scnr.Buffer([]byte{}, bufio.MaxScanTokenSize)
+		p.maxLineLen = bufio.MaxScanTokenSize
+	}
+}
+
+// RemoteAddr returns address of the peer if underlying stream provides it
+// (i.e. it is a net.Conn), nil otherwise (stdin/stdout, pipes).
+func (p *Pipe) RemoteAddr() net.Addr {
+	for _, s := range []interface{}{p.r, p.w} {
+		if conn, ok := s.(interface{ RemoteAddr() net.Addr }); ok {
+			return conn.RemoteAddr()
+		}
+	}
+	return nil
+}
+
+// SetMaxLineLen changes line length limit (including LF) for both read and
+// written lines. Data written by WriteData and WriteDataReader is split
+// into D lines according to new limit. ErrInvalidLineLen is returned and
+// limit is left unchanged if n is smaller than MinLineLen.
+//
+// Standard Assuan peers don't accept lines longer than MaxLineLen, so
+// limit should be raised only if peer agreed to it (see
+// client.Session.SetLineLength). Lowering it is always safe for written
+// lines, but peer's lines that don't fit are rejected.
+func (p *Pipe) SetMaxLineLen(n int) error {
+	if n < MinLineLen {
+		return ErrInvalidLineLen
+	}
+	p.maxLineLen = n
+	p.outLineLen = n
+	return nil
+}
+
+// Buffered returns amount of bytes that were received from peer but not
+// consumed by pipe yet.
+//
+// Non-zero value after complete response means that peer sent something
+// that was not asked for.
+func (p *Pipe) Buffered() int {
+	if p.hasPeeked {
+		// +1 for LF.
+		return p.rd.Buffered() + len(p.peeked) + 1
+	}
+	return p.rd.Buffered()
+}
+
+// LineTooLongError is returned when peer sent line longer than line length
+// limit. Rest of such line is discarded, so stream stays in consistent
+// state and next line can be read.
+//
+// errors.Is(err, bufio.ErrTooLong) is true for it.
+type LineTooLongError struct {
+	// Command of the discarded line (the first word), truncated if it
+	// doesn't fit into limit itself.
+	Cmd string
+	// Line length limit, including LF.
+	Limit int
+}
+
+func (e *LineTooLongError) Error() string {
+	return fmt.Sprintf("%s line is longer than %d bytes", e.Cmd, e.Limit)
+}
+
+func (e *LineTooLongError) Is(target error) bool {
+	return target == bufio.ErrTooLong
+}
+
+// readLine reads single line from stream without trailing LF (and CR, if
+// any). Lines longer than line length limit are discarded and
+// *LineTooLongError is returned.
+func (p *Pipe) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := p.rd.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > p.maxLineLen {
+			if err == bufio.ErrBufferFull {
+				if err := p.discardLine(); err != nil {
+					return "", err
+				}
+			}
+			cmd, _ := p.splitLine(string(line[:p.maxLineLen]))
+			Logger.Println("< too long line:", cmd)
+			return "", &LineTooLongError{Cmd: cmd, Limit: p.maxLineLen}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) != 0 {
+			// Last line without LF.
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	line = bytes.TrimSuffix(line, []byte{'\n'})
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	return string(line), nil
+}
+
+// discardLine reads and discards data up to the next LF.
+func (p *Pipe) discardLine() error {
+	for {
+		_, err := p.rd.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		return err
 	}
 }
 
 // ReadLine reads raw request/response in following format: command <parameters>
 //
 // Empty lines and lines starting with # are ignored as specified by protocol.
-// Additionally, status information is silently discarded for now.
+// Status (S) lines are skipped too, use ReadLineRaw to receive comments and
+// status lines (client.Session does so to pass them to callbacks set by
+// SetCommentCallback and SetStatusCallback). Parameters are unescaped.
 func (p *Pipe) ReadLine() (cmd string, params string, err error) {
-	var line string
 	for {
-		if ok := p.scnr.Scan(); !ok {
-			err := p.scnr.Err()
-			if err == nil {
-				err = io.EOF
-			}
+		cmd, params, err = p.ReadLineRaw()
+		if err != nil {
 			return "", "", err
 		}
-		line = p.scnr.Text()
 
 		// We got something that looks like a message. Let's parse it.
-		if !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "S ") && len(strings.TrimSpace(line)) != 0 {
+		if cmd != "#" && cmd != "S" {
 			break
 		}
 	}
 
+	params, err = unescapeParameters(params)
+	if err != nil {
+		return "", "", err
+	}
+	return cmd, params, nil
+}
+
+// ReadLineRaw is a lower-level version of ReadLine. It returns comments (with
+// "#" as a command) and status lines (with "S" as a command) and doesn't
+// unescape parameters.
+//
+// Empty lines are still ignored. Use ReadLineVerbatim to get lines exactly
+// as sent by peer.
+func (p *Pipe) ReadLineRaw() (cmd string, params string, err error) {
+	line, err := p.nextLine()
+	if err != nil {
+		return "", "", err
+	}
+
+	cmd, params = p.splitLine(line)
+	if cmd != "#" {
+		Logger.Println("<", cmd)
+	}
+	return cmd, params, nil
+}
+
+// Peek returns command of the next line without removing it from the
+// stream, subsequent ReadLine or ReadLineRaw call will return it.
+//
+// Peek sees lines same way as ReadLineRaw does, i.e. comments ("#") and
+// status lines ("S") are not skipped.
+func (p *Pipe) Peek() (cmd string, err error) {
+	if !p.hasPeeked {
+		line, err := p.nextLine()
+		if err != nil {
+			return "", err
+		}
+		p.peeked, p.hasPeeked = line, true
+	}
+
+	cmd, _ = p.splitLine(p.peeked)
+	return cmd, nil
+}
+
+// nextLine returns next non-empty line, either peeked one or read from
+// stream.
+func (p *Pipe) nextLine() (string, error) {
+	if p.hasPeeked {
+		p.hasPeeked = false
+		return p.peeked, nil
+	}
+
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return "", err
+		}
+
+		if len(strings.TrimSpace(line)) != 0 {
+			return line, nil
+		}
+	}
+}
+
+// ReadLineVerbatim reads single line without any processing and returns
+// it as is, without line terminator. Unlike ReadLineRaw, which skips
+// empty lines and splits line into command and parameters, it returns
+// every line, including empty ones.
+func (p *Pipe) ReadLineVerbatim() (string, error) {
+	if p.hasPeeked {
+		p.hasPeeked = false
+		return p.peeked, nil
+	}
+	return p.readLine()
+}
+
+// WriteRaw writes b to stream as is. Caller is responsible for proper
+// escaping and line termination. Data buffered by WriteData is sent before
+// b, nothing is left buffered.
+func (p *Pipe) WriteRaw(b []byte) error {
+	if err := p.write(b); err != nil {
+		return err
+	}
+	return p.Flush()
+}
+
+// Flush sends data lines buffered by WriteData and WriteDataReader to
+// peer. WriteLine (and so WriteStatus) calls it automatically, so it is
+// only needed if peer should see data before the next line is written.
+func (p *Pipe) Flush() error {
+	if err := p.wr.Flush(); err != nil {
+		p.wr.Reset(p.w)
+		return err
+	}
+	return nil
+}
+
+// write writes b to buffer, which is flushed to underlying writer when
+// full. If write fails, unsent data is discarded so the pipe can still be
+// used to send CAN if underlying writer is not broken permanently.
+func (p *Pipe) write(b []byte) error {
+	if _, err := p.wr.Write(b); err != nil {
+		p.wr.Reset(p.w)
+		return err
+	}
+	return nil
+}
+
+// splitLine splits line into command and (still escaped) parameters.
+func (p *Pipe) splitLine(line string) (cmd string, params string) {
+	if strings.HasPrefix(line, "#") {
+		return "#", strings.TrimPrefix(line[1:], " ")
+	}
+
 	// Part before first whitespace is a command. Everything after first whitespace is parameters.
 	parts := strings.SplitN(line, " ", 2)
 
 	// If there is no parameters... (huh!?)
 	if len(parts) == 1 {
-		return strings.ToUpper(parts[0]), "", nil
+		return p.normalizeCmd(parts[0]), ""
 	}
+	return p.normalizeCmd(parts[0]), parts[1]
+}
 
-	Logger.Println("<", parts[0])
-
-	params, err = unescapeParameters(parts[1])
-	if err != nil {
-		return "", "", err
+// normalizeCmd converts command to upper case since peer can send
+// commands in any case, unless CaseSensitive is set.
+func (p *Pipe) normalizeCmd(cmd string) string {
+	if p.CaseSensitive {
+		return cmd
 	}
-
-	// Command is "normalized" to upper case since peer can send
-	// commands in any case.
-	return strings.ToUpper(parts[0]), params, nil
+	return strings.ToUpper(cmd)
 }
 
 // WriteLine writes request/response to pipe.
 // Contents of params is escaped according to requirements of Assuan protocol.
+//
+// Line is sent to peer immediately, together with data lines buffered by
+// WriteData before it.
 func (p *Pipe) WriteLine(cmd string, params string) error {
-	if len(cmd)+len(params)+2 > MaxLineLen {
+	escaped := escapeParameters(params)
+	// 2 is for whitespace after command and LF
+	if len(cmd)+len(escaped)+2 > p.outLineLen {
 		Logger.Println("Refusing to send too long command")
-		// 2 is for whitespace after command and LF
-		return errors.New("too long command or parameters")
+		return ErrCmdTooLong
 	}
 
 	Logger.Println(">", cmd)
 
 	var line []byte
 	if params != "" {
-		line = []byte(strings.ToUpper(cmd) + " " + escapeParameters(params) + "\n")
+		line = []byte(p.normalizeCmd(cmd) + " " + escaped + "\n")
 	} else {
-		line = []byte(strings.ToUpper(cmd) + "\n")
+		line = []byte(p.normalizeCmd(cmd) + "\n")
 	}
-	_, err := p.w.Write(line)
-	return err
-}
-
-func min(a, b int) int {
-	if a <= b {
-		return a
+	if err := p.write(line); err != nil {
+		return err
 	}
-	return b
+	return p.Flush()
 }
 
 // WriteData sends passed byte slice using one or more D commands.
+//
+// Lines are buffered and sent to peer together with the next line written
+// by WriteLine (i.e. END, OK or ERR) or when buffer of dataWriteBufSize
+// bytes is full, so large payloads don't result in write call per line.
+// Use Flush to send them earlier.
+//
 // Note: Error may occur even after some data is written so it's better
 // to just CAN transaction after WriteData error.
 func (p *Pipe) WriteData(input []byte) error {
-	encoded := []byte(escapeParameters(string(input)))
-	chunkLen := MaxLineLen - 3 // 3 is for 'D ' and line feed.
-	for i := 0; i < len(encoded); i += chunkLen {
-		chunk := encoded[i:min(i+chunkLen, len(encoded))]
-		chunk = append([]byte{'D', ' '}, chunk...)
-		chunk = append(chunk, '\n')
-
-		if _, err := p.w.Write(chunk); err != nil {
+	encoded := escapeData(string(input))
+	chunkLen := p.dataChunkLen()
+
+	line := make([]byte, 0, chunkLen+3)
+	for len(encoded) != 0 {
+		n := len(encoded)
+		if n > chunkLen {
+			n = chunkLen
+			// Don't split escape sequence (%XX) between lines.
+			if i := strings.LastIndexByte(encoded[n-2:n], '%'); i != -1 {
+				n = n - 2 + i
+			}
+		}
+
+		line = append(line[:0], 'D', ' ')
+		line = append(line, encoded[:n]...)
+		line = append(line, '\n')
+		if err := p.write(line); err != nil {
 			return err
 		}
+		encoded = encoded[n:]
 	}
 	return nil
 }
 
+// dataWriteBufSize is a size of buffer used for D lines, i.e. maximum
+// amount of data written in one call to underlying writer.
+const dataWriteBufSize = 64 * 1024
+
+func (p *Pipe) dataChunkLen() int {
+	chunkLen := p.outLineLen - 3 // 3 is for 'D ' and line feed.
+	if p.DataChunkSize > 0 && p.DataChunkSize < chunkLen {
+		chunkLen = p.DataChunkSize
+	}
+	// Chunk should fit at least one escape sequence (%XX).
+	if chunkLen < 3 {
+		chunkLen = 3
+	}
+	return chunkLen
+}
+
 // WriteDataReader is similar to WriteData but sends data from input Reader
 // until EOF.
 func (p *Pipe) WriteDataReader(input io.Reader) error {
-	chunkLen := MaxLineLen - 3 // 3 is for 'D ' and line feed.
-	buf := make([]byte, chunkLen)
+	buf := make([]byte, p.dataChunkLen())
 
 	for {
 		n, err := input.Read(buf)
+		if n != 0 {
+			if err := p.WriteData(buf[:n]); err != nil {
+				return err
+			}
+		}
 		if err == io.EOF {
 			return nil
 		}
 		if err != nil {
 			return err
 		}
+	}
+}
 
-		chunk := []byte(escapeParameters(string(buf[:n])))
-		chunk = append([]byte{'D', ' '}, chunk...)
-		chunk = append(chunk, '\n')
-		if _, err := p.w.Write(chunk); err != nil {
-			return err
-		}
+// Inquire sends INQUIRE with specified keyword (optionally followed by
+// parameters) and reads data sent by peer in response to it (see
+// ReadData).
+//
+// If peer cancelled inquiry by sending CAN, *Error with ErrAssCanceled code
+// is returned. Neither OK nor ERR is sent by Inquire.
+func (p *Pipe) Inquire(keyword string) ([]byte, error) {
+	if err := p.WriteLine("INQUIRE", keyword); err != nil {
+		return nil, err
 	}
+	return p.ReadData()
 }
 
 // ReadData reads sequence of D commands and joins data together.
+//
+// Protocol errors are returned as *Error, so server handlers can return
+// them as is to report them to client.
+//
+// *Error with ErrAssCanceled code is returned if peer sent CAN. END without
+// any D lines before it results in empty non-nil slice, so "no data" can
+// be told apart from cancellation just by checking the error.
+//
+// If MaxDataSize is set and peer sends more data than allowed, remaining
+// data is read and discarded until END and *Error with ErrAssTooMuchData
+// code is returned.
 func (p *Pipe) ReadData() (data []byte, err error) {
+	tooMuch := false
 	for {
 		cmd, chunk, err := p.ReadLine()
 		if err != nil {
@@ -183,29 +495,130 @@ func (p *Pipe) ReadData() (data []byte, err error) {
 		}
 
 		if cmd == "END" {
+			if tooMuch {
+				return nil, NewAssuanError(ErrAssTooMuchData, "too much data")
+			}
+			if data == nil {
+				data = []byte{}
+			}
 			return data, nil
 		}
 
 		if cmd == "CAN" {
-			return nil, Error{Src: ErrSrcAssuan, Code: ErrUnexpected, SrcName: "assuan", Message: "IPC call has been cancelled"}
+			return nil, NewAssuanError(ErrAssCanceled, "IPC call has been cancelled")
 		}
 
 		if cmd != "D" {
-			return nil, Error{Src: ErrSrcAssuan, Code: ErrUnexpected, SrcName: "assuan", Message: "unexpected IPC command"}
+			return nil, NewAssuanError(ErrUnexpected, "unexpected IPC command")
 		}
 
-		unescaped, err := unescapeParameters(chunk)
-		if err != nil {
-			return nil, err
+		if tooMuch {
+			continue
+		}
+		if p.MaxDataSize != 0 && len(data)+len(chunk) > p.MaxDataSize {
+			Logger.Println("Data size limit exceeded, discarding remaining data")
+			tooMuch = true
+			data = nil
+			continue
 		}
 
-		data = append(data, []byte(unescaped)...)
+		// Chunk is already unescaped by ReadLine.
+		data = append(data, []byte(chunk)...)
+	}
+}
+
+// WriteStatus is special case of WriteLine. It writes status line (S) with
+// specified keyword and value.
+//
+// Keyword is not escaped and can contain only letters, digits, '_' and '-'.
+// Value is escaped as usual and can be empty.
+//
+// Line is sent to peer immediately, so handlers can use it to report
+// progress of long-running operations.
+func (p *Pipe) WriteStatus(keyword, value string) error {
+	if !statusKeywordRe.MatchString(keyword) {
+		return errors.New("invalid status keyword")
+	}
+	if value == "" {
+		return p.WriteLine("S", keyword)
 	}
+	return p.WriteLine("S", keyword+" "+value)
+}
+
+var statusKeywordRe = regexp.MustCompile(`^[\w\-]+$`)
+
+// ParseStatus splits parameters of status line (as returned by ReadLineRaw)
+// into keyword and value. Value is unescaped, keyword is returned as is.
+//
+// Value is empty if status line contains only keyword. Spaces between
+// keyword and value are skipped.
+func ParseStatus(params string) (keyword, value string, err error) {
+	parts := strings.SplitN(params, " ", 2)
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+	value, err = unescapeParameters(strings.TrimLeft(parts[1], " "))
+	if err != nil {
+		return "", "", err
+	}
+	return parts[0], value, nil
 }
 
 // WriteComment is special case of WriteLine. "Command" is # and text is parameter.
+//
+// Multi-line text is sent as several comment lines instead of escaping
+// line feeds since peers display comments literally. Text that doesn't fit
+// into single line is wrapped over several comment lines, preferably at
+// spaces.
 func (p *Pipe) WriteComment(text string) error {
-	return p.WriteLine("#", text)
+	for _, para := range strings.Split(text, "\n") {
+		para = strings.TrimSuffix(para, "\r")
+		for _, line := range wrapComment(para, p.outLineLen-3) { // 3 is for "# " and LF.
+			if err := p.WriteLine("#", line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// wrapComment splits text into pieces that take at most maxLen bytes after
+// escaping. Pieces are split at last space (which is dropped) if possible,
+// multi-byte UTF-8 sequences are never split.
+func wrapComment(text string, maxLen int) []string {
+	var lines []string
+	for {
+		escapedLen, cut := 0, len(text)
+		for i := 0; i < len(text); i++ {
+			if escapedChars[text[i]] {
+				escapedLen += 3
+			} else {
+				escapedLen++
+			}
+			if escapedLen > maxLen {
+				cut = i
+				break
+			}
+		}
+		if cut == len(text) {
+			return append(lines, text)
+		}
+
+		if sp := strings.LastIndexByte(text[:cut], ' '); sp > 0 {
+			lines = append(lines, text[:sp])
+			text = text[sp+1:]
+			continue
+		}
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			// Should not happen with any sane maxLen.
+			return append(lines, text)
+		}
+		lines = append(lines, text[:cut])
+		text = text[cut:]
+	}
 }
 
 // WriteError is a special case of WriteLine. It writes command.s
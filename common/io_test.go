@@ -1,7 +1,13 @@
 package common_test
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -39,6 +45,51 @@ func TestPipe_ReadLine(t *testing.T) {
 			t.Error("pipe.ReadLine should fail, but succeed")
 		}
 	})
+	t.Run("too long line is discarded", func(t *testing.T) {
+		sample := "INQUIRE " + strings.Repeat("F", 5000) + "\nOK done\n"
+		pipe := common.NewPipe(strings.NewReader(sample), nil)
+
+		_, _, err := pipe.ReadLine()
+		lerr, ok := err.(*common.LineTooLongError)
+		if !ok {
+			t.Fatal("Expected LineTooLongError, got:", err)
+		}
+		if lerr.Cmd != "INQUIRE" || lerr.Limit != common.MaxLineLen {
+			t.Errorf("Wrong error: %#v", lerr)
+		}
+		if !errors.Is(err, bufio.ErrTooLong) {
+			t.Error("LineTooLongError is not bufio.ErrTooLong")
+		}
+
+		cmd, params, err := pipe.ReadLine()
+		if err != nil {
+			t.Fatal("Unexpected error on pipe.ReadLine:", err)
+		}
+		if cmd != "OK" || params != "done" {
+			t.Errorf("Wrong line after too long one: %s %s", cmd, params)
+		}
+	})
+	t.Run("case sensitive", func(t *testing.T) {
+		sample := "cmd params\nCmd\n"
+		pipe := common.NewPipe(strings.NewReader(sample), nil)
+		pipe.CaseSensitive = true
+		defer pipe.Close()
+
+		cmd, _, err := pipe.ReadLine()
+		if err != nil {
+			t.Error("Unexpected error on pipe.ReadLine:", err)
+		}
+		if cmd != "cmd" {
+			t.Errorf("Command mismatch: wanted %s, got %s", "cmd", cmd)
+		}
+		cmd, _, err = pipe.ReadLine()
+		if err != nil {
+			t.Error("Unexpected error on pipe.ReadLine:", err)
+		}
+		if cmd != "Cmd" {
+			t.Errorf("Command mismatch: wanted %s, got %s", "Cmd", cmd)
+		}
+	})
 	t.Run("comments", func(t *testing.T) {
 		sample := `# asd asd df d fd fd f
 # as d sf d fd f df d 
@@ -60,6 +111,39 @@ CMD F!_)`
 	})
 }
 
+func TestPipe_Peek(t *testing.T) {
+	pipe := common.NewPipe(strings.NewReader("\nS PROGRESS x\nINQUIRE KEYBLOCK\nOK\n"), nil)
+
+	for i := 0; i < 2; i++ {
+		cmd, err := pipe.Peek()
+		if err != nil {
+			t.Fatal("Unexpected Peek error:", err)
+		}
+		if cmd != "S" {
+			t.Fatal("Peek returned wrong command:", cmd)
+		}
+	}
+
+	// Status line is skipped by ReadLine as usual.
+	cmd, params, err := pipe.ReadLine()
+	if err != nil {
+		t.Fatal("Unexpected ReadLine error:", err)
+	}
+	if cmd != "INQUIRE" || params != "KEYBLOCK" {
+		t.Fatal("Wrong line read after Peek:", cmd, params)
+	}
+
+	if cmd, err := pipe.Peek(); err != nil || cmd != "OK" {
+		t.Fatal("Peek returned wrong command:", cmd, err)
+	}
+	if cmd, _, err := pipe.ReadLineRaw(); err != nil || cmd != "OK" {
+		t.Fatal("Wrong line read after Peek:", cmd, err)
+	}
+	if _, err := pipe.Peek(); err != io.EOF {
+		t.Fatal("Expected io.EOF, got:", err)
+	}
+}
+
 func TestPipe_WriteLine(t *testing.T) {
 	t.Run("simple write: CMD par\\rams", func(t *testing.T) {
 		buf := bytes.Buffer{}
@@ -76,6 +160,20 @@ func TestPipe_WriteLine(t *testing.T) {
 			t.Errorf("pipe.WriteLine wrote incorrect line: '%s'", buf.String())
 		}
 	})
+	t.Run("case sensitive", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+		pipe.CaseSensitive = true
+		defer pipe.Close()
+
+		if err := pipe.WriteLine("cmd", "params"); err != nil {
+			t.Error("Unexpected error on pipe.WriteLine:", err)
+			t.FailNow()
+		}
+		if buf.String() != "cmd params\n" {
+			t.Errorf("pipe.WriteLine wrote incorrect line: '%s'", buf.String())
+		}
+	})
 	t.Run("too long line", func(t *testing.T) {
 		buf := bytes.Buffer{}
 		pipe := common.NewPipe(nil, &buf)
@@ -86,6 +184,42 @@ func TestPipe_WriteLine(t *testing.T) {
 			t.Error("pipe.WriteLine didn't refused to write too long line")
 		}
 	})
+	t.Run("no parameters", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(&buf, &buf)
+
+		if err := pipe.WriteLine("NOP", ""); err != nil {
+			t.Fatal("Unexpected error on pipe.WriteLine:", err)
+		}
+		if buf.String() != "NOP\n" {
+			t.Fatalf("pipe.WriteLine wrote incorrect line: %q", buf.String())
+		}
+
+		// Peer may send trailing space anyway.
+		buf.WriteString("NOP \n")
+		for i := 0; i < 2; i++ {
+			cmd, params, err := pipe.ReadLine()
+			if err != nil {
+				t.Fatal("Unexpected error on pipe.ReadLine:", err)
+			}
+			if cmd != "NOP" || params != "" {
+				t.Errorf("Wrong line read: %q %q", cmd, params)
+			}
+		}
+	})
+	t.Run("too long line after escaping", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+
+		err := pipe.WriteLine("CMD", strings.Repeat("%", common.MaxLineLen/2))
+
+		if err != common.ErrCmdTooLong {
+			t.Error("Expected ErrCmdTooLong, got:", err)
+		}
+		if buf.Len() != 0 {
+			t.Error("Something was written:", buf.String())
+		}
+	})
 }
 
 func TestPipe_WriteData(t *testing.T) {
@@ -100,6 +234,9 @@ func TestPipe_WriteData(t *testing.T) {
 			t.Error("Unexpected error on pipe.WriteData:", err)
 			t.FailNow()
 		}
+		if err := pipe.Flush(); err != nil {
+			t.Fatal("Unexpected error on pipe.Flush:", err)
+		}
 		if buf.String() != "D %0DBC\n" {
 			t.Errorf("pipe.WriteLine wrote incorrect line: '%s'", buf.String())
 		}
@@ -116,6 +253,9 @@ func TestPipe_WriteData(t *testing.T) {
 		if err != nil {
 			t.Error("Unexpected error on pipe.WriteData:", err)
 		}
+		if err := pipe.Flush(); err != nil {
+			t.Fatal("Unexpected error on pipe.Flush:", err)
+		}
 		splitten := strings.Split(buf.String(), "\n")
 		for _, part := range splitten {
 			if len(part)+1 > common.MaxLineLen {
@@ -124,6 +264,113 @@ func TestPipe_WriteData(t *testing.T) {
 			}
 		}
 	})
+	t.Run("buffered writes", func(t *testing.T) {
+		w := countingWriter{}
+		pipe := common.NewPipe(nil, &w)
+		defer pipe.Close()
+
+		if err := pipe.WriteData([]byte(strings.Repeat("F", common.MaxLineLen*7))); err != nil {
+			t.Fatal("Unexpected error on pipe.WriteData:", err)
+		}
+		if w.writes != 0 {
+			t.Errorf("Data is written before Flush: %d write calls", w.writes)
+		}
+		if err := pipe.WriteLine("END", ""); err != nil {
+			t.Fatal("Unexpected error on pipe.WriteLine:", err)
+		}
+		if w.writes != 1 || !strings.HasSuffix(w.String(), "\nEND\n") {
+			t.Errorf("Expected data and END in 1 write call, got %d", w.writes)
+		}
+
+		w = countingWriter{}
+		data := []byte(strings.Repeat("%", 1024*1024))
+		if err := pipe.WriteDataReader(bytes.NewReader(data)); err != nil {
+			t.Fatal("Unexpected error on pipe.WriteDataReader:", err)
+		}
+		if err := pipe.WriteLine("END", ""); err != nil {
+			t.Fatal("Unexpected error on pipe.WriteLine:", err)
+		}
+		if w.writes < 2 || w.writes > 100 {
+			t.Errorf("Unexpected number of write calls: %d", w.writes)
+		}
+		readPipe := common.NewPipe(&w.Buffer, nil)
+		readData, err := readPipe.ReadData()
+		if err != nil {
+			t.Fatal("Unexpected error on pipe.ReadData:", err)
+		}
+		if !bytes.Equal(readData, data) {
+			t.Error("pipe.ReadData read different data")
+		}
+	})
+	t.Run("write error", func(t *testing.T) {
+		w := countingWriter{failWrites: 1}
+		pipe := common.NewPipe(nil, &w)
+		defer pipe.Close()
+
+		if err := pipe.WriteData([]byte("ABC")); err != nil {
+			t.Fatal("Unexpected error on pipe.WriteData:", err)
+		}
+		if err := pipe.Flush(); err == nil {
+			t.Fatal("Expected error on pipe.Flush")
+		}
+		// Unsent data is discarded, CAN can be sent.
+		if err := pipe.WriteLine("CAN", ""); err != nil {
+			t.Fatal("Unexpected error on pipe.WriteLine:", err)
+		}
+		if w.String() != "CAN\n" {
+			t.Errorf("Wrong output after write error: %q", w.String())
+		}
+	})
+	t.Run("DataChunkSize", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+		pipe.DataChunkSize = 4
+		defer pipe.Close()
+
+		if err := pipe.WriteData([]byte("ABC%DE")); err != nil {
+			t.Error("Unexpected error on pipe.WriteData:", err)
+			t.FailNow()
+		}
+		if err := pipe.Flush(); err != nil {
+			t.Fatal("Unexpected error on pipe.Flush:", err)
+		}
+		if buf.String() != "D ABC\nD %25D\nD E\n" {
+			t.Errorf("pipe.WriteData wrote wrong lines: '%s'", buf.String())
+		}
+	})
+	t.Run("SetMaxLineLen", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(&buf, &buf)
+		defer pipe.Close()
+
+		if err := pipe.SetMaxLineLen(common.MinLineLen - 1); err != common.ErrInvalidLineLen {
+			t.Error("Expected ErrInvalidLineLen for too small limit, got", err)
+		}
+		if err := pipe.SetMaxLineLen(8); err != nil {
+			t.Fatal("Unexpected error on pipe.SetMaxLineLen:", err)
+		}
+		if err := pipe.WriteData([]byte("ABCDEF%G")); err != nil {
+			t.Fatal("Unexpected error on pipe.WriteData:", err)
+		}
+		if err := pipe.Flush(); err != nil {
+			t.Fatal("Unexpected error on pipe.Flush:", err)
+		}
+		if buf.String() != "D ABCDE\nD F%25G\n" {
+			t.Errorf("pipe.WriteData wrote wrong lines: '%s'", buf.String())
+		}
+		if err := pipe.WriteLine("TOOLONG", ""); err != common.ErrCmdTooLong {
+			t.Error("Expected ErrCmdTooLong, got", err)
+		}
+
+		buf.Reset()
+		buf.WriteString("D 123456\nD 1234\n")
+		if _, _, err := pipe.ReadLine(); !errors.Is(err, bufio.ErrTooLong) {
+			t.Error("Expected too long line error, got", err)
+		}
+		if _, params, err := pipe.ReadLine(); err != nil || params != "1234" {
+			t.Errorf("Unexpected pipe.ReadLine result: %q, %v", params, err)
+		}
+	})
 	t.Run("from io.Reader", func(t *testing.T) {
 		buf := bytes.Buffer{}
 		pipe := common.NewPipe(nil, &buf)
@@ -137,11 +384,63 @@ func TestPipe_WriteData(t *testing.T) {
 			t.Error("Unexpected error on pipe.WriteData:", err)
 			t.FailNow()
 		}
+		if err := pipe.Flush(); err != nil {
+			t.Fatal("Unexpected error on pipe.Flush:", err)
+		}
 		if buf.String() != "D ABCDEF\n" {
 			t.Errorf("pipe.WriteData wrote wrong line: '%s'", buf.String())
 		}
 	})
-	// TODO: Test that wrapping is done correctly and no data is corrupted.
+	t.Run("wrapping preserves data", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(&buf, &buf)
+		defer pipe.Close()
+
+		// Escaped form of each byte takes 3 characters so escape sequences
+		// will cross chunk boundaries at different offsets.
+		data := []byte(strings.Repeat("%\n\rA", common.MaxLineLen))
+
+		if err := pipe.WriteData(data); err != nil {
+			t.Error("Unexpected error on pipe.WriteData:", err)
+			t.FailNow()
+		}
+		if err := pipe.Flush(); err != nil {
+			t.Fatal("Unexpected error on pipe.Flush:", err)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+			if len(line)+1 > common.MaxLineLen {
+				t.Error("pipe.WriteData wrote line bigger than MaxLineLen")
+				t.FailNow()
+			}
+		}
+		buf.WriteString("END\n")
+
+		readData, err := pipe.ReadData()
+		if err != nil {
+			t.Error("Unexpected error on pipe.ReadData:", err)
+			t.FailNow()
+		}
+		if !bytes.Equal(readData, data) {
+			t.Error("pipe.ReadData read different data")
+		}
+	})
+}
+
+// countingWriter is bytes.Buffer that counts Write calls. First failWrites
+// calls fail.
+type countingWriter struct {
+	bytes.Buffer
+	writes     int
+	failWrites int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	if w.failWrites > 0 {
+		w.failWrites--
+		return 0, errors.New("write failed")
+	}
+	return w.Buffer.Write(b)
 }
 
 func TestPipe_ReadData(t *testing.T) {
@@ -197,3 +496,211 @@ END
 		}
 	})
 }
+
+func TestPipe_Inquire(t *testing.T) {
+	t.Run("data", func(t *testing.T) {
+		out := bytes.Buffer{}
+		pipe := common.NewPipe(strings.NewReader("D 30%0A\nD 31\nEND\n"), &out)
+
+		data, err := pipe.Inquire("HASHVAL")
+		if err != nil {
+			t.Fatal("Unexpected error on pipe.Inquire:", err)
+		}
+		if string(data) != "30\n31" {
+			t.Errorf("Wrong data: %q", data)
+		}
+		if out.String() != "INQUIRE HASHVAL\n" {
+			t.Errorf("Wrong output: %q", out.String())
+		}
+	})
+	t.Run("empty", func(t *testing.T) {
+		pipe := common.NewPipe(strings.NewReader("END\n"), ioutil.Discard)
+
+		data, err := pipe.Inquire("HASHVAL")
+		if err != nil {
+			t.Fatal("Unexpected error on pipe.Inquire:", err)
+		}
+		if data == nil || len(data) != 0 {
+			t.Errorf("Expected empty non-nil data, got %#v", data)
+		}
+	})
+	t.Run("cancelled", func(t *testing.T) {
+		pipe := common.NewPipe(strings.NewReader("D 30\nCAN\n"), ioutil.Discard)
+
+		_, err := pipe.Inquire("HASHVAL")
+		if perr, ok := err.(*common.Error); !ok || perr.Code != common.ErrAssCanceled {
+			t.Error("Expected ErrAssCanceled, got:", err)
+		}
+	})
+}
+
+func TestPipe_Status(t *testing.T) {
+	t.Run("round-trip", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(&buf, &buf)
+		defer pipe.Close()
+
+		if err := pipe.WriteStatus("PROGRESS", "50% done, 100%25 soon"); err != nil {
+			t.Error("Unexpected error on pipe.WriteStatus:", err)
+			t.FailNow()
+		}
+		if buf.String() != "S PROGRESS 50%25 done, 100%2525 soon\n" {
+			t.Errorf("pipe.WriteStatus wrote incorrect line: '%s'", buf.String())
+		}
+
+		cmd, params, err := pipe.ReadLineRaw()
+		if err != nil {
+			t.Error("Unexpected error on pipe.ReadLineRaw:", err)
+			t.FailNow()
+		}
+		if cmd != "S" {
+			t.Errorf("Command mismatch: wanted %s, got %s", "S", cmd)
+		}
+		keyword, value, err := common.ParseStatus(params)
+		if err != nil {
+			t.Error("Unexpected error on common.ParseStatus:", err)
+			t.FailNow()
+		}
+		if keyword != "PROGRESS" {
+			t.Errorf("Keyword mismatch: wanted %s, got %s", "PROGRESS", keyword)
+		}
+		if value != "50% done, 100%25 soon" {
+			t.Errorf("Value mismatch: wanted '%s', got '%s'", "50% done, 100%25 soon", value)
+		}
+	})
+	t.Run("keyword only", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(&buf, &buf)
+
+		if err := pipe.WriteStatus("TRUNCATED", ""); err != nil {
+			t.Fatal("Unexpected error on pipe.WriteStatus:", err)
+		}
+		if buf.String() != "S TRUNCATED\n" {
+			t.Errorf("pipe.WriteStatus wrote incorrect line: '%s'", buf.String())
+		}
+
+		for _, params := range []string{"TRUNCATED", "TRUNCATED ", "TRUNCATED   "} {
+			keyword, value, err := common.ParseStatus(params)
+			if err != nil {
+				t.Fatal("Unexpected error on common.ParseStatus:", err)
+			}
+			if keyword != "TRUNCATED" || value != "" {
+				t.Errorf("Wrong result for '%s': keyword '%s', value '%s'", params, keyword, value)
+			}
+		}
+	})
+	t.Run("extra spaces", func(t *testing.T) {
+		keyword, value, err := common.ParseStatus("PROGRESS   50 %25")
+		if err != nil {
+			t.Fatal("Unexpected error on common.ParseStatus:", err)
+		}
+		if keyword != "PROGRESS" || value != "50 %" {
+			t.Errorf("Wrong result: keyword '%s', value '%s'", keyword, value)
+		}
+	})
+	t.Run("invalid keyword", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+		defer pipe.Close()
+
+		for _, keyword := range []string{"", "BAD KEYWORD", "BAD%20", "BAD\n"} {
+			if err := pipe.WriteStatus(keyword, "value"); err == nil {
+				t.Errorf("pipe.WriteStatus accepted invalid keyword: '%s'", keyword)
+			}
+		}
+		if buf.Len() != 0 {
+			t.Errorf("pipe.WriteStatus wrote something: '%s'", buf.String())
+		}
+	})
+	t.Run("skipped by ReadLine", func(t *testing.T) {
+		sample := "S PROGRESS 50\n# comment\nOK\n"
+		pipe := common.NewPipe(strings.NewReader(sample), nil)
+		defer pipe.Close()
+
+		cmd, _, err := pipe.ReadLine()
+		if err != nil {
+			t.Error("Unexpected error on pipe.ReadLine:", err)
+			t.FailNow()
+		}
+		if cmd != "OK" {
+			t.Errorf("Command mismatch: wanted %s, got %s", "OK", cmd)
+		}
+	})
+}
+
+func TestPipe_WriteComment(t *testing.T) {
+	cases := []struct {
+		name string
+		text string
+	}{
+		{"short", "short comment"},
+		{"words", strings.Repeat("word ", 300)},
+		{"no spaces", strings.Repeat("x", 2500)},
+		{"escaped", strings.Repeat("%", 700)},
+		{"multi-byte", strings.Repeat("é", 700)},
+		{"newlines", "first\nsecond\r\n\nfourth"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			pipe := common.NewPipe(&buf, &buf)
+
+			if err := pipe.WriteComment(c.text); err != nil {
+				t.Fatal("Unexpected error on pipe.WriteComment:", err)
+			}
+
+			var text []string
+			for buf.Len() != 0 || pipe.Buffered() != 0 {
+				cmd, params, err := pipe.ReadLineRaw()
+				if err != nil {
+					t.Fatal("Unexpected error on pipe.ReadLineRaw:", err)
+				}
+				if cmd != "#" {
+					t.Fatalf("Command mismatch: wanted %s, got %s", "#", cmd)
+				}
+				if len("# "+params+"\n") > common.MaxLineLen {
+					t.Errorf("Too long comment line: %d", len(params))
+				}
+				unescaped, err := common.Unescape(params)
+				if err != nil {
+					t.Fatal("Unexpected error on common.Unescape:", err)
+				}
+				text = append(text, unescaped)
+			}
+
+			joined := strings.Join(text, "")
+			switch c.name {
+			case "words":
+				joined = strings.Join(text, " ")
+			case "newlines":
+				if !reflect.DeepEqual(text, []string{"first", "second", "", "fourth"}) {
+					t.Errorf("Wrong lines: %q", text)
+				}
+				return
+			}
+			if joined != c.text {
+				t.Errorf("Text mismatch after wrapping (%d lines)", len(text))
+			}
+		})
+	}
+}
+
+func BenchmarkPipe_WriteData(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	for _, size := range []int{64, 256, 0} {
+		name := "default"
+		if size != 0 {
+			name = strconv.Itoa(size)
+		}
+		b.Run(name, func(b *testing.B) {
+			pipe := common.NewPipe(nil, ioutil.Discard)
+			pipe.DataChunkSize = size
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if err := pipe.WriteData(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package pinentry
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os/exec"
 	"strconv"
@@ -63,8 +65,24 @@ func (c *Client) Reset() error {
 	return c.Session.Reset()
 }
 
+// setText sends command with text parameter.
+func (c *Client) setText(cmd, text string) error {
+	_, err := c.Session.SimpleCmd(cmd, text)
+	if errors.Is(err, common.ErrCmdTooLong) {
+		return fmt.Errorf("pinentry: text for %s is too long: %w", cmd, err)
+	}
+	return err
+}
+
+// SetDesc sets detailed description of request.
+//
+// Text (as well as text passed to other setters) is sent in single line
+// and so limited to common.MaxLineLen bytes including command name. CR, LF,
+// % and backslash take 3 bytes each because of escaping. Over-long text is
+// rejected with error wrapping common.ErrCmdTooLong and is never
+// truncated.
 func (c *Client) SetDesc(text string) error {
-	if _, err := c.Session.SimpleCmd("SETDESC", text); err != nil {
+	if err := c.setText("SETDESC", text); err != nil {
 		return err
 	}
 	c.current.Desc = text
@@ -72,7 +90,7 @@ func (c *Client) SetDesc(text string) error {
 }
 
 func (c *Client) SetPrompt(text string) error {
-	if _, err := c.Session.SimpleCmd("SETPROMPT", text); err != nil {
+	if err := c.setText("SETPROMPT", text); err != nil {
 		return err
 	}
 	c.current.Prompt = text
@@ -80,7 +98,7 @@ func (c *Client) SetPrompt(text string) error {
 }
 
 func (c *Client) SetError(text string) error {
-	if _, err := c.Session.SimpleCmd("SETERROR", text); err != nil {
+	if err := c.setText("SETERROR", text); err != nil {
 		return err
 	}
 	c.current.Error = text
@@ -88,7 +106,7 @@ func (c *Client) SetError(text string) error {
 }
 
 func (c *Client) SetOkBtn(text string) error {
-	if _, err := c.Session.SimpleCmd("SETOK", text); err != nil {
+	if err := c.setText("SETOK", text); err != nil {
 		return err
 	}
 	c.current.OkBtn = text
@@ -96,7 +114,7 @@ func (c *Client) SetOkBtn(text string) error {
 }
 
 func (c *Client) SetNotOkBtn(text string) error {
-	if _, err := c.Session.SimpleCmd("SETNOTOK", text); err != nil {
+	if err := c.setText("SETNOTOK", text); err != nil {
 		return err
 	}
 	c.current.NotOkBtn = text
@@ -104,7 +122,7 @@ func (c *Client) SetNotOkBtn(text string) error {
 }
 
 func (c *Client) SetCancelBtn(text string) error {
-	if _, err := c.Session.SimpleCmd("SETCANCEL", text); err != nil {
+	if err := c.setText("SETCANCEL", text); err != nil {
 		return err
 	}
 	c.current.CancelBtn = text
@@ -112,7 +130,7 @@ func (c *Client) SetCancelBtn(text string) error {
 }
 
 func (c *Client) SetTitle(text string) error {
-	if _, err := c.Session.SimpleCmd("SETTITLE", text); err != nil {
+	if err := c.setText("SETTITLE", text); err != nil {
 		return err
 	}
 	c.current.Title = text
@@ -120,7 +138,7 @@ func (c *Client) SetTitle(text string) error {
 }
 
 func (c *Client) SetTimeout(timeout time.Duration) error {
-	if _, err := c.Session.SimpleCmd("SETTIMEOUT", strconv.Itoa(int(timeout.Seconds()))); err != nil {
+	if _, err := c.Session.SimpleCmd("SETTIMEOUT", strconv.Itoa(int(timeout/time.Second))); err != nil {
 		return err
 	}
 	c.current.Timeout = timeout
@@ -128,7 +146,7 @@ func (c *Client) SetTimeout(timeout time.Duration) error {
 }
 
 func (c *Client) SetRepeatPrompt(text string) error {
-	if _, err := c.Session.SimpleCmd("SETREPEAT", text); err != nil {
+	if err := c.setText("SETREPEAT", text); err != nil {
 		return err
 	}
 	c.current.RepeatPrompt = text
@@ -136,7 +154,7 @@ func (c *Client) SetRepeatPrompt(text string) error {
 }
 
 func (c *Client) SetRepeatError(text string) error {
-	if _, err := c.Session.SimpleCmd("SETREPEATERROR", text); err != nil {
+	if err := c.setText("SETREPEATERROR", text); err != nil {
 		return err
 	}
 	c.current.RepeatError = text
@@ -144,7 +162,7 @@ func (c *Client) SetRepeatError(text string) error {
 }
 
 func (c *Client) SetQualityBar(text string) error {
-	if _, err := c.Session.SimpleCmd("SETQUALITYBAR", text); err != nil {
+	if err := c.setText("SETQUALITYBAR", text); err != nil {
 		return err
 	}
 	c.current.QualityBar = text
@@ -221,60 +239,70 @@ func (c *Client) getPINWithQualBar() (string, error) {
 
 	defer func() { c.qualityBar = false }()
 
-	pipe := c.Session.Pipe
-	if err := pipe.WriteLine("GETPIN", ""); err != nil {
-		return "", err
-	}
-	for {
-		cmd, params, err := pipe.ReadLine()
-		if err != nil {
-			return "", err
+	var pin string
+	err := c.Session.WithRawPipe(func(pipe *common.Pipe) error {
+		if err := pipe.WriteLine("GETPIN", ""); err != nil {
+			return err
 		}
+		for {
+			cmd, params, err := pipe.ReadLine()
+			if err != nil {
+				return err
+			}
 
-		if cmd == "D" {
-			// We got password.
+			if cmd == "D" {
+				// We got password.
 
-			// Take OK from pipe.
-			if _, _, err := pipe.ReadLine(); err != nil {
-				return "", err
-			}
+				// Take OK from pipe.
+				if _, _, err := pipe.ReadLine(); err != nil {
+					return err
+				}
 
-			return params, nil
-		}
+				pin = params
+				return nil
+			}
 
-		if cmd == "INQUIRE" {
-			// params[8:] is
-			//  QUALITY password-here
-			//          ^~~~~~~~~~~~~
-			passwd := params[8:]
+			if cmd == "INQUIRE" {
+				// params[8:] is
+				//  QUALITY password-here
+				//          ^~~~~~~~~~~~~
+				passwd := params[8:]
+
+				if c.current.PasswordQuality == nil {
+					if err := pipe.WriteLine("D", "0"); err != nil {
+						return err
+					}
+					if err := pipe.WriteLine("END", ""); err != nil {
+						return err
+					}
+					continue
+				}
 
-			if c.current.PasswordQuality == nil {
-				if err := pipe.WriteLine("D", "0"); err != nil {
-					return "", err
+				quality := c.current.PasswordQuality(passwd)
+				if err := pipe.WriteLine("D", strconv.Itoa(quality)); err != nil {
+					return err
 				}
 				if err := pipe.WriteLine("END", ""); err != nil {
-					return "", err
+					return err
 				}
-				continue
 			}
 
-			quality := c.current.PasswordQuality(passwd)
-			if err := pipe.WriteLine("D", strconv.Itoa(quality)); err != nil {
-				return "", err
-			}
-			if err := pipe.WriteLine("END", ""); err != nil {
-				return "", err
+			if cmd == "ERR" {
+				return common.DecodeErrCmd(params)
 			}
 		}
-
-		if cmd == "ERR" {
-			return "", common.DecodeErrCmd(params)
-		}
+	})
+	if err != nil {
+		return "", err
 	}
+	return pin, nil
 }
 
 // Confirm shows window with Cancel and Ok buttons but without password
 // textbox, error is returned if Cancel is pressed (as usual).
+//
+// If NOT OK button is enabled (SetNotOkBtn), pressing it results in error
+// with ErrNotConfirmed code while Cancel results in ErrCanceled.
 func (c *Client) Confirm() error {
 	_, err := c.Session.SimpleCmd("CONFIRM", "")
 	return err
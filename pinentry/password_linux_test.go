@@ -0,0 +1,77 @@
+package pinentry
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func openPty(t *testing.T) (master, slave *os.File) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip("pty is not available:", err)
+	}
+
+	var unlock int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		master.Close()
+		t.Skip("pty is not available:", errno)
+	}
+	var n uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); errno != 0 {
+		master.Close()
+		t.Skip("pty is not available:", errno)
+	}
+	slave, err = os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		t.Skip("pty is not available:", err)
+	}
+	return master, slave
+}
+
+func TestReadPasswordFromTTY(t *testing.T) {
+	master, slave := openPty(t)
+	defer master.Close()
+	defer slave.Close()
+
+	// Input is echoed as soon as it is received, so wait until echo is
+	// disabled before "typing".
+	go func() {
+		for i := 0; i < 500; i++ {
+			term, err := getTermios(slave.Fd())
+			if err == nil && term.Lflag&syscall.ECHO == 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		master.Write([]byte("secret\n"))
+	}()
+
+	pass, err := ReadPasswordFromTTY(slave)
+	if err != nil {
+		t.Fatal("Unexpected ReadPasswordFromTTY error:", err)
+	}
+	if string(pass) != "secret" {
+		t.Errorf("Password mismatch: wanted %s, got %s", "secret", pass)
+	}
+
+	// Only line feed should be echoed (as CR LF, due to output processing).
+	master.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	echo := make([]byte, 64)
+	n, _ := master.Read(echo)
+	if string(echo[:n]) != "\r\n" {
+		t.Errorf("Unexpected echo: %q", echo[:n])
+	}
+
+	term, err := getTermios(slave.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if term.Lflag&syscall.ECHO == 0 {
+		t.Error("Echo is not restored")
+	}
+}
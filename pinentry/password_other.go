@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package pinentry
+
+import (
+	"errors"
+	"os"
+)
+
+// ReadPasswordFromTTY reads single line from terminal with echo disabled.
+//
+// Not supported on this platform, error is always returned.
+func ReadPasswordFromTTY(f *os.File) ([]byte, error) {
+	return nil, errors.New("reading password from terminal is not supported on this platform")
+}
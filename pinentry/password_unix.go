@@ -0,0 +1,104 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package pinentry
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+func getTermios(fd uintptr) (*syscall.Termios, error) {
+	t := &syscall.Termios{}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, ioctlGetTermios, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return nil, errno
+	}
+	return t, nil
+}
+
+func setTermios(fd uintptr, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, ioctlSetTermios, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ReadPasswordFromTTY reads single line from terminal with echo disabled.
+// Line terminator is not included in returned slice. io.EOF is returned if
+// user sent EOF without entering anything.
+//
+// Terminal state is restored before return. If process receives SIGINT or
+// SIGTERM while waiting for input, terminal state is restored and signal is
+// re-raised.
+func ReadPasswordFromTTY(f *os.File) ([]byte, error) {
+	fd := f.Fd()
+	orig, err := getTermios(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	noEcho := *orig
+	noEcho.Lflag &^= syscall.ECHO
+	// Still echo line feed so following output starts on new line.
+	noEcho.Lflag |= syscall.ICANON | syscall.ECHONL
+	if err := setTermios(fd, &noEcho); err != nil {
+		return nil, err
+	}
+
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			setTermios(fd, orig)
+			signal.Stop(sigs)
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				p.Signal(sig)
+			}
+		case <-done:
+		}
+	}()
+	defer func() {
+		signal.Stop(sigs)
+		close(done)
+		setTermios(fd, orig)
+	}()
+
+	return readPasswordLine(f)
+}
+
+// readPasswordLine reads bytes until LF one by one to not consume anything
+// past the line.
+func readPasswordLine(r io.Reader) ([]byte, error) {
+	var buf [1]byte
+	var pass []byte
+	for {
+		n, err := r.Read(buf[:])
+		if n != 0 {
+			if buf[0] == '\n' {
+				break
+			}
+			pass = append(pass, buf[0])
+		}
+		if err == io.EOF {
+			if len(pass) == 0 {
+				return nil, io.EOF
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(pass) != 0 && pass[len(pass)-1] == '\r' {
+		pass = pass[:len(pass)-1]
+	}
+	return pass, nil
+}
@@ -1,70 +1,102 @@
 package pinentry
 
 import (
+	"fmt"
+	"os"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/foxcpp/go-assuan/common"
 	"github.com/foxcpp/go-assuan/server"
 )
 
+// Callbacks implement operations requested by client.
+//
+// Settings passed to callbacks is a copy of session state at the time of
+// request, so it reflects values set by the most recent SETDESC, SETPROMPT
+// and other SET* commands. Protocol has single description shared by all
+// operations, client (gpg-agent) sends SETDESC with relevant text before
+// each GETPIN, CONFIRM or MESSAGE.
 type Callbacks struct {
-	GetPIN  func(Settings) (string, *common.Error)
+	GetPIN func(Settings) (string, *common.Error)
+	// Confirm should return true if user pressed OK button and false if
+	// user pressed NOT OK button (or Cancel, if NOT OK button is not
+	// shown, i.e. Settings.NotOkBtn is empty). If both buttons are shown,
+	// Cancel should be reported by returning error with ErrCanceled code.
 	Confirm func(Settings) (bool, *common.Error)
 	Msg     func(Settings) *common.Error
+
+	// If set, consulted before calling GetPIN if client enabled
+	// allow-external-password-cache option and sent key info using
+	// SETKEYINFO. Passphrases returned by GetPIN are stored in it.
+	Cache PassphraseCache
+}
+
+// PassphraseCache is a storage for passphrases, keyed by key info as sent
+// by client (SETKEYINFO).
+type PassphraseCache interface {
+	Lookup(keyInfo string) (string, bool)
+	Store(keyInfo, pw string)
 }
 
-func setDesc(_ *common.Pipe, state interface{}, params string) error {
+func setDesc(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
 	state.(*Settings).Desc = params
-	return nil
+	return nil, nil
 }
-func setPrompt(_ *common.Pipe, state interface{}, params string) error {
+func setPrompt(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
 	state.(*Settings).Prompt = params
-	return nil
+	return nil, nil
 }
-func setRepeat(_ *common.Pipe, state interface{}, params string) error {
+func setRepeat(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
 	state.(*Settings).RepeatPrompt = params
-	return nil
+	return nil, nil
 }
-func setRepeatError(_ *common.Pipe, state interface{}, params string) error {
+func setRepeatError(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
 	state.(*Settings).RepeatError = params
-	return nil
+	return nil, nil
 }
-func setError(_ *common.Pipe, state interface{}, params string) error {
+func setError(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
 	state.(*Settings).Error = params
-	return nil
+	return nil, nil
 }
-func setOk(_ *common.Pipe, state interface{}, params string) error {
+func setOk(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
 	state.(*Settings).OkBtn = params
-	return nil
+	return nil, nil
 }
-func setNotOk(_ *common.Pipe, state interface{}, params string) error {
+func setNotOk(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
 	state.(*Settings).NotOkBtn = params
-	return nil
+	return nil, nil
 }
-func setCancel(_ *common.Pipe, state interface{}, params string) error {
+func setCancel(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
 	state.(*Settings).CancelBtn = params
-	return nil
+	return nil, nil
 }
-func setQualityBar(_ *common.Pipe, state interface{}, params string) error {
+func setQualityBar(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
 	state.(*Settings).QualityBar = params
-	return nil
+	return nil, nil
 }
-func setTitle(_ *common.Pipe, state interface{}, params string) error {
+func setQualityBarTT(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
+	state.(*Settings).QualityBarTT = params
+	return nil, nil
+}
+func setTitle(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
 	state.(*Settings).Title = params
-	return nil
+	return nil, nil
+}
+func setKeyInfo(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
+	if params == "--clear" {
+		params = ""
+	}
+	state.(*Settings).KeyInfo = params
+	return nil, nil
 }
-func setTimeout(_ *common.Pipe, state interface{}, params string) error {
+func setTimeout(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
 	i, err := strconv.Atoi(params)
 	if err != nil {
-		return &common.Error{
-			Src: common.ErrSrcPinentry, Code: common.ErrAssInvValue,
-			SrcName: "pinentry", Message: "invalid timeout value",
-		}
+		return common.NewPinentryError(common.ErrAssInvValue, "invalid timeout value"), nil
 	}
-	state.(*Settings).Timeout = time.Duration(i)
-	return nil
+	state.(*Settings).SetTimeoutSeconds(i)
+	return nil, nil
 }
 func setOpt(state interface{}, key string, val string) error {
 	opts := state.(*Settings)
@@ -77,6 +109,10 @@ func setOpt(state interface{}, key string, val string) error {
 		opts.Opts.Grab = true
 		return nil
 	}
+	if key == "display" {
+		opts.Opts.Display = val
+		return nil
+	}
 	if key == "ttytype" {
 		opts.Opts.TTYType = val
 		return nil
@@ -122,100 +158,152 @@ func setOpt(state interface{}, key string, val string) error {
 		return nil
 	}
 
-	return &common.Error{
-		Src: common.ErrSrcPinentry, Code: common.ErrUnknownOption,
-		SrcName: "pinentry", Message: "unknown option: " + key,
+	return common.NewPinentryError(common.ErrUnknownOption, "unknown option: "+key)
+}
+
+// Version is reported to client in response to "GETINFO version".
+var Version = "1.0.0"
+
+func getInfo(pipe *common.Pipe, state interface{}, params string) (*common.Error, error) {
+	opts := state.(*Settings).Opts
+
+	switch params {
+	case "version":
+		return nil, pipe.WriteData([]byte(Version))
+	case "pid":
+		return nil, pipe.WriteData([]byte(strconv.Itoa(os.Getpid())))
+	case "ttyinfo":
+		orDash := func(s string) string {
+			if s == "" {
+				return "-"
+			}
+			return s
+		}
+		info := fmt.Sprintf("%s %s %s", orDash(opts.TTYName), orDash(opts.TTYType), orDash(opts.Display))
+		return nil, pipe.WriteData([]byte(info))
 	}
+	return common.NewPinentryError(common.ErrAssParameter, "unknown GETINFO subcommand"), nil
 }
 
-func resetState(_ *common.Pipe, state interface{}, _ string) error {
+func resetState(_ *common.Pipe, state interface{}, _ string) (*common.Error, error) {
 	*(state.(*Settings)) = Settings{}
-	return nil
+	return nil, nil
 }
 
 var ProtoInfo = server.ProtoInfo{
 	Greeting: "go-assuan pinentry",
 	Handlers: map[string]server.CommandHandler{
-		"SETDESC":        setDesc,
-		"SETPROMPT":      setPrompt,
-		"SETREPEAT":      setRepeat,
-		"SETREPEATERROR": setRepeatError,
-		"SETERROR":       setError,
-		"SETOK":          setOk,
-		"SETNOTOK":       setNotOk,
-		"SETCANCEL":      setCancel,
-		"SETQUALITYBAR":  setQualityBar,
-		"SETTITLE":       setTitle,
-		"SETTIMEOUT":     setTimeout,
-		"RESET":          resetState,
+		"SETDESC":          setDesc,
+		"SETPROMPT":        setPrompt,
+		"SETREPEAT":        setRepeat,
+		"SETREPEATERROR":   setRepeatError,
+		"SETERROR":         setError,
+		"SETOK":            setOk,
+		"SETNOTOK":         setNotOk,
+		"SETCANCEL":        setCancel,
+		"SETQUALITYBAR":    setQualityBar,
+		"SETQUALITYBAR_TT": setQualityBarTT,
+		"SETTITLE":         setTitle,
+		"SETTIMEOUT":       setTimeout,
+		"SETKEYINFO":       setKeyInfo,
+		"GETINFO":          getInfo,
+		"RESET":            resetState,
 	},
 	Help: map[string][]string{}, // TODO
 	GetDefaultState: func() interface{} {
-		return Settings{}
+		return &Settings{}
 	},
 	SetOption: setOpt,
 }
 
 func Serve(callbacks Callbacks, customGreeting string) error {
+	return server.ServeStdin(newProtoInfo(callbacks, customGreeting))
+}
+
+// newProtoInfo returns copy of ProtoInfo with handlers for callbacks added.
+// ProtoInfo itself is not modified so concurrent calls with different
+// callbacks don't interfere.
+func newProtoInfo(callbacks Callbacks, customGreeting string) server.ProtoInfo {
 	info := ProtoInfo
 
 	if len(customGreeting) != 0 {
 		info.Greeting = customGreeting
 	}
 
-	info.Handlers["GETPIN"] = func(pipe *common.Pipe, state interface{}, _ string) error {
-		if callbacks.GetPIN == nil {
-			Logger.Println("GETPIN requested but not supported")
-			return &common.Error{
-				Src: common.ErrSrcPinentry, Code: common.ErrNotImplemented,
-				SrcName: "pinentry", Message: "GETPIN op is not supported",
-			}
-		}
-
-		pass, err := callbacks.GetPIN(*state.(*Settings))
-		if err != nil {
-			return err
+	info.Handlers = make(map[string]server.CommandHandler, len(ProtoInfo.Handlers)+3)
+	for cmd, h := range ProtoInfo.Handlers {
+		info.Handlers[cmd] = h
+	}
+	info.Handlers["GETPIN"] = getPINHandler(callbacks)
+	info.Handlers["CONFIRM"] = confirmHandler(callbacks)
+	info.Handlers["MESSAGE"] = func(pipe *common.Pipe, state interface{}, _ string) (*common.Error, error) {
+		if callbacks.Msg == nil {
+			Logger.Println("MESSAGE requested but not supported")
+			return common.NewPinentryError(common.ErrNotImplemented, "MESSAGE op is not supported"), nil
 		}
 
-		if err := pipe.WriteData([]byte(pass)); err != nil {
-			return nil
+		if err := callbacks.Msg(*state.(*Settings)); err != nil {
+			return err, nil
 		}
-		return nil
+		return nil, nil
 	}
-	info.Handlers["CONFIRM"] = func(pipe *common.Pipe, state interface{}, _ string) error {
+	return info
+}
+
+func confirmHandler(callbacks Callbacks) server.CommandHandler {
+	return func(pipe *common.Pipe, state interface{}, _ string) (*common.Error, error) {
 		if callbacks.Confirm == nil {
 			Logger.Println("CONFIRM requested but not supported")
-			return &common.Error{
-				Src: common.ErrSrcPinentry, Code: common.ErrNotImplemented,
-				SrcName: "pinentry", Message: "CONFIRM op is not supported",
-			}
+			return common.NewPinentryError(common.ErrNotImplemented, "CONFIRM op is not supported"), nil
 		}
 
-		v, err := callbacks.Confirm(*state.(*Settings))
+		settings := state.(*Settings)
+		v, err := callbacks.Confirm(*settings)
 		if err != nil {
-			return err
+			return err, nil
 		}
 
 		if !v {
-			return &common.Error{
-				Src: common.ErrSrcPinentry, Code: common.ErrCanceled,
-				SrcName: "pinentry", Message: "operation canceled",
+			// gpg-agent treats "not ok" as a negative answer (i.e. don't
+			// trust the key) and cancel as abort of operation.
+			if settings.NotOkBtn != "" {
+				return common.NewPinentryError(common.ErrNotConfirmed, "not confirmed"), nil
 			}
+			return common.NewPinentryError(common.ErrCanceled, "operation canceled"), nil
 		}
-		return nil
+		return nil, nil
 	}
-	info.Handlers["MESSAGE"] = func(pipe *common.Pipe, state interface{}, _ string) error {
-		if callbacks.Msg == nil {
-			Logger.Println("MESSAGE requested but not supported")
-			return &common.Error{
-				Src: common.ErrSrcPinentry, Code: common.ErrNotImplemented,
-				SrcName: "pinentry", Message: "MESSAGE op is not supported",
+}
+
+func getPINHandler(callbacks Callbacks) server.CommandHandler {
+	return func(pipe *common.Pipe, state interface{}, _ string) (*common.Error, error) {
+		settings := state.(*Settings)
+
+		// Cache is not used if previous attempt failed (client sent error
+		// text), since cached passphrase is likely the wrong one.
+		useCache := callbacks.Cache != nil && settings.Opts.AllowExtPasswdCache && settings.KeyInfo != ""
+		if useCache && settings.Error == "" {
+			if pass, ok := callbacks.Cache.Lookup(settings.KeyInfo); ok {
+				if err := pipe.WriteStatus("PASSWORD_FROM_CACHE", ""); err != nil {
+					return nil, err
+				}
+				return nil, pipe.WriteData([]byte(pass))
 			}
 		}
 
-		return callbacks.Msg(*state.(*Settings))
-	}
+		if callbacks.GetPIN == nil {
+			Logger.Println("GETPIN requested but not supported")
+			return common.NewPinentryError(common.ErrNotImplemented, "GETPIN op is not supported"), nil
+		}
 
-	err := server.ServeStdin(info)
-	return err
+		pass, err := callbacks.GetPIN(*settings)
+		if err != nil {
+			return err, nil
+		}
+		if useCache {
+			callbacks.Cache.Store(settings.KeyInfo, pass)
+		}
+
+		return nil, pipe.WriteData([]byte(pass))
+	}
 }
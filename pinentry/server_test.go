@@ -0,0 +1,282 @@
+package pinentry
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/foxcpp/go-assuan/common"
+	"github.com/foxcpp/go-assuan/server"
+)
+
+type mapCache map[string]string
+
+func (c mapCache) Lookup(keyInfo string) (string, bool) {
+	pw, ok := c[keyInfo]
+	return pw, ok
+}
+
+func (c mapCache) Store(keyInfo, pw string) {
+	c[keyInfo] = pw
+}
+
+func TestGetPIN_Cache(t *testing.T) {
+	getPIN := func(called *bool) func(Settings) (string, *common.Error) {
+		return func(Settings) (string, *common.Error) {
+			*called = true
+			return "entered", nil
+		}
+	}
+	settings := func() *Settings {
+		s := &Settings{KeyInfo: "n/0123456789ABCDEF"}
+		s.Opts.AllowExtPasswdCache = true
+		return s
+	}
+
+	t.Run("hit", func(t *testing.T) {
+		called := false
+		cache := mapCache{"n/0123456789ABCDEF": "cached"}
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+
+		h := getPINHandler(Callbacks{GetPIN: getPIN(&called), Cache: cache})
+		if perr, err := h(&pipe, settings(), ""); perr != nil || err != nil {
+			t.Fatal("Unexpected error:", perr, err)
+		}
+		if called {
+			t.Error("GetPIN called on cache hit")
+		}
+		if err := pipe.Flush(); err != nil {
+			t.Fatal("Unexpected error on pipe.Flush:", err)
+		}
+		if buf.String() != "S PASSWORD_FROM_CACHE\nD cached\n" {
+			t.Errorf("Wrong output: %q", buf.String())
+		}
+	})
+	t.Run("miss", func(t *testing.T) {
+		called := false
+		cache := mapCache{}
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+
+		h := getPINHandler(Callbacks{GetPIN: getPIN(&called), Cache: cache})
+		if perr, err := h(&pipe, settings(), ""); perr != nil || err != nil {
+			t.Fatal("Unexpected error:", perr, err)
+		}
+		if !called {
+			t.Error("GetPIN not called on cache miss")
+		}
+		if err := pipe.Flush(); err != nil {
+			t.Fatal("Unexpected error on pipe.Flush:", err)
+		}
+		if buf.String() != "D entered\n" {
+			t.Errorf("Wrong output: %q", buf.String())
+		}
+		if cache["n/0123456789ABCDEF"] != "entered" {
+			t.Error("Passphrase is not stored in cache")
+		}
+	})
+	t.Run("option not set", func(t *testing.T) {
+		called := false
+		cache := mapCache{"n/0123456789ABCDEF": "cached"}
+		pipe := common.NewPipe(nil, &bytes.Buffer{})
+
+		s := settings()
+		s.Opts.AllowExtPasswdCache = false
+		h := getPINHandler(Callbacks{GetPIN: getPIN(&called), Cache: cache})
+		if perr, err := h(&pipe, s, ""); perr != nil || err != nil {
+			t.Fatal("Unexpected error:", perr, err)
+		}
+		if !called {
+			t.Error("Cache used without allow-external-password-cache")
+		}
+		if cache["n/0123456789ABCDEF"] != "cached" {
+			t.Error("Cache modified without allow-external-password-cache")
+		}
+	})
+	t.Run("retry after error", func(t *testing.T) {
+		called := false
+		cache := mapCache{"n/0123456789ABCDEF": "cached"}
+		pipe := common.NewPipe(nil, &bytes.Buffer{})
+
+		s := settings()
+		s.Error = "Bad passphrase"
+		h := getPINHandler(Callbacks{GetPIN: getPIN(&called), Cache: cache})
+		if perr, err := h(&pipe, s, ""); perr != nil || err != nil {
+			t.Fatal("Unexpected error:", perr, err)
+		}
+		if !called {
+			t.Error("Cached passphrase used after error")
+		}
+		if cache["n/0123456789ABCDEF"] != "entered" {
+			t.Error("Cached passphrase is not replaced")
+		}
+	})
+}
+
+func TestSetKeyInfoCmd(t *testing.T) {
+	s := &Settings{}
+	if perr, err := setKeyInfo(nil, s, "n/0123456789ABCDEF"); perr != nil || err != nil {
+		t.Fatal("Unexpected setKeyInfo error:", perr, err)
+	}
+	if s.KeyInfo != "n/0123456789ABCDEF" {
+		t.Errorf("KeyInfo mismatch: got %s", s.KeyInfo)
+	}
+	if perr, err := setKeyInfo(nil, s, "--clear"); perr != nil || err != nil {
+		t.Fatal("Unexpected setKeyInfo error:", perr, err)
+	}
+	if s.KeyInfo != "" {
+		t.Errorf("KeyInfo is not cleared: got %s", s.KeyInfo)
+	}
+}
+
+func TestGetInfoCmd(t *testing.T) {
+	s := &Settings{}
+	s.Opts.TTYName = "/dev/pts/1"
+	s.Opts.TTYType = "xterm"
+
+	cases := []struct {
+		params   string
+		expected string
+	}{
+		{"version", "D " + Version + "\n"},
+		{"pid", "D " + strconv.Itoa(os.Getpid()) + "\n"},
+		{"ttyinfo", "D /dev/pts/1 xterm -\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.params, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			pipe := common.NewPipe(nil, &buf)
+			if perr, err := getInfo(&pipe, s, c.params); perr != nil || err != nil {
+				t.Fatal("Unexpected getInfo error:", perr, err)
+			}
+			if err := pipe.Flush(); err != nil {
+				t.Fatal("Unexpected error on pipe.Flush:", err)
+			}
+			if buf.String() != c.expected {
+				t.Errorf("Wrong output: wanted %q, got %q", c.expected, buf.String())
+			}
+		})
+	}
+	t.Run("unknown", func(t *testing.T) {
+		pipe := common.NewPipe(nil, &bytes.Buffer{})
+		perr, err := getInfo(&pipe, s, "flavor")
+		if err != nil || perr == nil || perr.Code != common.ErrAssParameter {
+			t.Error("Expected ErrAssParameter, got:", perr, err)
+		}
+	})
+}
+
+func TestConfirmCmd(t *testing.T) {
+	confirm := func(v bool, err *common.Error) func(Settings) (bool, *common.Error) {
+		return func(Settings) (bool, *common.Error) {
+			return v, err
+		}
+	}
+	cancelErr := common.NewPinentryError(common.ErrCanceled, "operation canceled")
+
+	cases := []struct {
+		name     string
+		notOkBtn string
+		confirm  func(Settings) (bool, *common.Error)
+		code     common.ErrorCode
+	}{
+		{"ok", "", confirm(true, nil), 0},
+		{"cancel", "", confirm(false, nil), common.ErrCanceled},
+		{"ok with not ok button", "No", confirm(true, nil), 0},
+		{"not ok", "No", confirm(false, nil), common.ErrNotConfirmed},
+		{"cancel with not ok button", "No", confirm(false, cancelErr), common.ErrCanceled},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pipe := common.NewPipe(nil, &bytes.Buffer{})
+			h := confirmHandler(Callbacks{Confirm: c.confirm})
+
+			perr, err := h(&pipe, &Settings{NotOkBtn: c.notOkBtn}, "")
+			if err != nil {
+				t.Fatal("Unexpected fatal error:", err)
+			}
+			if c.code == 0 {
+				if perr != nil {
+					t.Error("Unexpected error:", perr)
+				}
+				return
+			}
+			if perr == nil || perr.Code != c.code {
+				t.Errorf("Expected error with code %d, got: %v", c.code, perr)
+			}
+		})
+	}
+}
+
+func TestNewProtoInfo_Concurrent(t *testing.T) {
+	pins := []string{"first", "second"}
+	infos := make([]server.ProtoInfo, len(pins))
+
+	var wg sync.WaitGroup
+	for i, pin := range pins {
+		wg.Add(1)
+		go func(i int, pin string) {
+			defer wg.Done()
+			infos[i] = newProtoInfo(Callbacks{
+				GetPIN: func(Settings) (string, *common.Error) { return pin, nil },
+			}, "")
+		}(i, pin)
+	}
+	wg.Wait()
+
+	if _, ok := ProtoInfo.Handlers["GETPIN"]; ok {
+		t.Error("Global ProtoInfo.Handlers is modified")
+	}
+	for i, pin := range pins {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+		if perr, err := infos[i].Handlers["GETPIN"](&pipe, &Settings{}, ""); perr != nil || err != nil {
+			t.Fatal("Unexpected GETPIN error:", perr, err)
+		}
+		if err := pipe.Flush(); err != nil {
+			t.Fatal("Unexpected error on pipe.Flush:", err)
+		}
+		if buf.String() != "D "+pin+"\n" {
+			t.Errorf("Handlers of call %d are clobbered: %q", i, buf.String())
+		}
+	}
+}
+
+func TestMessageCmd(t *testing.T) {
+	buf := bytes.Buffer{}
+	pipe := common.NewPipe(nil, &buf)
+
+	info := newProtoInfo(Callbacks{Msg: func(Settings) *common.Error { return nil }}, "")
+	if perr, err := info.Handlers["MESSAGE"](&pipe, &Settings{}, ""); perr != nil || err != nil {
+		t.Errorf("Unexpected MESSAGE error: %v, %v", perr, err)
+	}
+}
+
+func TestCallbacks_LatestDesc(t *testing.T) {
+	var descs []string
+	callbacks := Callbacks{
+		GetPIN: func(s Settings) (string, *common.Error) {
+			descs = append(descs, "GETPIN: "+s.Desc)
+			return "1234", nil
+		},
+		Confirm: func(s Settings) (bool, *common.Error) {
+			descs = append(descs, "CONFIRM: "+s.Desc)
+			return true, nil
+		},
+	}
+	in := strings.NewReader("SETDESC Enter PIN\nGETPIN\nSETDESC Trust this key?\nCONFIRM\nSETDESC Enter new PIN\nGETPIN\n")
+	err := server.Serve(common.ReadWriter{Reader: in, Writer: &bytes.Buffer{}}, newProtoInfo(callbacks, ""))
+	if err != nil {
+		t.Fatal("Unexpected Serve error:", err)
+	}
+
+	expected := []string{"GETPIN: Enter PIN", "CONFIRM: Trust this key?", "GETPIN: Enter new PIN"}
+	if !reflect.DeepEqual(descs, expected) {
+		t.Errorf("Wrong descriptions: %q", descs)
+	}
+}
@@ -35,6 +35,9 @@ type Settings struct {
 	// Window title.
 	Title string
 	// Prompt timeout. Any user interaction disables timeout.
+	//
+	// Protocol transfers timeout as whole number of seconds, use
+	// TimeoutSeconds and SetTimeoutSeconds for convenience.
 	Timeout time.Duration
 	// Text right before repeat textbox.
 	// Repeat textbox is hidden after GetPin.
@@ -43,8 +46,24 @@ type Settings struct {
 	RepeatError string
 	// Text before password quality bar.
 	QualityBar string
+	// Tooltip for password quality bar.
+	QualityBarTT string
+	// Key identifier as sent by SETKEYINFO, used as a key for passphrase
+	// cache. Empty if client didn't sent it.
+	KeyInfo string
 	// Password quality callback.
 	PasswordQuality func(string) int
 
 	Opts Options
 }
+
+// TimeoutSeconds returns prompt timeout as a whole number of seconds, as
+// it is transferred over protocol.
+func (s Settings) TimeoutSeconds() int {
+	return int(s.Timeout / time.Second)
+}
+
+// SetTimeoutSeconds sets prompt timeout to specified number of seconds.
+func (s *Settings) SetTimeoutSeconds(secs int) {
+	s.Timeout = time.Duration(secs) * time.Second
+}
@@ -0,0 +1,28 @@
+package pinentry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSettings_Timeout(t *testing.T) {
+	s := Settings{}
+	s.SetTimeoutSeconds(30)
+	if s.Timeout != 30*time.Second {
+		t.Errorf("Timeout mismatch: wanted %v, got %v", 30*time.Second, s.Timeout)
+	}
+	if s.TimeoutSeconds() != 30 {
+		t.Errorf("TimeoutSeconds mismatch: wanted %d, got %d", 30, s.TimeoutSeconds())
+	}
+}
+
+func TestSetTimeoutCmd(t *testing.T) {
+	s := &Settings{}
+	if perr, err := setTimeout(nil, s, "15"); perr != nil || err != nil {
+		t.Error("Unexpected setTimeout error:", perr, err)
+		t.FailNow()
+	}
+	if s.Timeout != 15*time.Second {
+		t.Errorf("Timeout mismatch: wanted %v, got %v", 15*time.Second, s.Timeout)
+	}
+}
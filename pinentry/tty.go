@@ -0,0 +1,128 @@
+package pinentry
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/foxcpp/go-assuan/common"
+)
+
+// TTYCallbacks returns Callbacks implementation that interacts with user
+// using terminal.
+//
+// Terminal specified by ttyname option (gpg-agent sets it from GPG_TTY) is
+// used. If it is not set, controlling terminal of the process (/dev/tty) is
+// used instead. Standard input can't be used because it is used as protocol
+// channel by Serve.
+//
+// PIN is read with terminal echo disabled (see ReadPasswordFromTTY).
+func TTYCallbacks() Callbacks {
+	return Callbacks{
+		GetPIN:  ttyGetPIN,
+		Confirm: ttyConfirm,
+		Msg:     ttyMsg,
+	}
+}
+
+// OpenTTY opens terminal with specified name for reading and writing. If
+// name is empty, controlling terminal of the process (/dev/tty) is opened.
+//
+// Use it to interact with user when standard input and output are used as
+// protocol channel (as in Serve or server.ServeStdin).
+func OpenTTY(name string) (*os.File, error) {
+	if name == "" {
+		name = "/dev/tty"
+	}
+	return os.OpenFile(name, os.O_RDWR, 0)
+}
+
+// PromptLine writes prompt to tty and reads single line of user input from
+// it. Line terminator is not included in returned string. io.EOF is returned
+// if user sent EOF without entering anything.
+func PromptLine(tty io.ReadWriter, prompt string) (string, error) {
+	if _, err := io.WriteString(tty, prompt); err != nil {
+		return "", err
+	}
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func ttyError(err error) *common.Error {
+	return common.NewPinentryError(common.ErrGeneral, "terminal I/O error: "+err.Error())
+}
+
+func printHeader(w io.Writer, s Settings) {
+	if s.Title != "" {
+		fmt.Fprintln(w, s.Title)
+	}
+	if s.Desc != "" {
+		fmt.Fprintln(w, s.Desc)
+	}
+	if s.Error != "" {
+		fmt.Fprintln(w, s.Error)
+	}
+}
+
+func ttyGetPIN(s Settings) (string, *common.Error) {
+	tty, err := OpenTTY(s.Opts.TTYName)
+	if err != nil {
+		return "", ttyError(err)
+	}
+	defer tty.Close()
+
+	printHeader(tty, s)
+	prompt := s.Prompt
+	if prompt == "" {
+		prompt = "PIN:"
+	}
+	if _, err := io.WriteString(tty, prompt+" "); err != nil {
+		return "", ttyError(err)
+	}
+	pin, err := ReadPasswordFromTTY(tty)
+	if err == io.EOF {
+		return "", common.NewPinentryError(common.ErrCanceled, "operation canceled")
+	}
+	if err != nil {
+		return "", ttyError(err)
+	}
+	return string(pin), nil
+}
+
+func ttyConfirm(s Settings) (bool, *common.Error) {
+	tty, err := OpenTTY(s.Opts.TTYName)
+	if err != nil {
+		return false, ttyError(err)
+	}
+	defer tty.Close()
+
+	printHeader(tty, s)
+	answer, err := PromptLine(tty, "Confirm? [y/N] ")
+	if err == io.EOF {
+		return false, common.NewPinentryError(common.ErrCanceled, "operation canceled")
+	}
+	if err != nil {
+		return false, ttyError(err)
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+func ttyMsg(s Settings) *common.Error {
+	tty, err := OpenTTY(s.Opts.TTYName)
+	if err != nil {
+		return ttyError(err)
+	}
+	defer tty.Close()
+
+	printHeader(tty, s)
+	if _, err := PromptLine(tty, "Press Enter to continue..."); err != nil && err != io.EOF {
+		return ttyError(err)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package pinentry
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/go-assuan/common"
+)
+
+func TestPromptLine(t *testing.T) {
+	t.Run("line", func(t *testing.T) {
+		out := bytes.Buffer{}
+		tty := common.ReadWriter{Reader: strings.NewReader("1234\r\n5678\n"), Writer: &out}
+
+		line, err := PromptLine(tty, "PIN: ")
+		if err != nil {
+			t.Error("Unexpected PromptLine error:", err)
+			t.FailNow()
+		}
+		if line != "1234" {
+			t.Errorf("Line mismatch: wanted %s, got %s", "1234", line)
+		}
+		if out.String() != "PIN: " {
+			t.Errorf("Prompt mismatch: wanted '%s', got '%s'", "PIN: ", out.String())
+		}
+	})
+	t.Run("no line terminator", func(t *testing.T) {
+		tty := common.ReadWriter{Reader: strings.NewReader("1234"), Writer: ioutil.Discard}
+
+		line, err := PromptLine(tty, "PIN: ")
+		if err != nil {
+			t.Error("Unexpected PromptLine error:", err)
+			t.FailNow()
+		}
+		if line != "1234" {
+			t.Errorf("Line mismatch: wanted %s, got %s", "1234", line)
+		}
+	})
+	t.Run("EOF", func(t *testing.T) {
+		tty := common.ReadWriter{Reader: strings.NewReader(""), Writer: ioutil.Discard}
+
+		if _, err := PromptLine(tty, "PIN: "); err != io.EOF {
+			t.Error("Expected io.EOF, got:", err)
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/go-assuan/common"
+)
+
+// auditRecord is a structure of JSON record written to ProtoInfo.AuditWriter.
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Command    string    `json:"command"`
+	ParamsLen  int       `json:"params_len"`
+	Result     int       `json:"result"`
+	Duration   float64   `json:"duration"`
+}
+
+// Serializes writes to ProtoInfo.AuditWriter.
+var auditLck sync.Mutex
+
+// audit writes record about executed command to ProtoInfo.AuditWriter, if
+// it is set. Errors are logged but not returned since failed audit should
+// not break the session.
+func (s *session) audit(start time.Time, cmd, params string, perr *common.Error, err error) {
+	if s.proto.AuditWriter == nil {
+		return
+	}
+
+	rec := auditRecord{
+		Time:       start.UTC(),
+		RemoteAddr: s.remoteAddr,
+		Command:    cmd,
+		ParamsLen:  len(params),
+		Duration:   time.Since(start).Seconds(),
+	}
+	if err != nil {
+		rec.Result = -1
+	} else if perr != nil {
+		rec.Result = common.MakeErrCode(perr.Src, perr.Code)
+	}
+
+	blob, merr := json.Marshal(rec)
+	if merr != nil {
+		Logger.Println("Failed to marshal audit record:", merr)
+		return
+	}
+	blob = append(blob, '\n')
+
+	auditLck.Lock()
+	defer auditLck.Unlock()
+	if _, werr := s.proto.AuditWriter.Write(blob); werr != nil {
+		Logger.Println("Failed to write audit record:", werr)
+	}
+}
@@ -1,11 +1,10 @@
 package server_test
 
 import (
-	"bufio"
 	"fmt"
-	"os"
 
 	"github.com/foxcpp/go-assuan/common"
+	"github.com/foxcpp/go-assuan/pinentry"
 	"github.com/foxcpp/go-assuan/server"
 )
 
@@ -13,31 +12,43 @@ type State struct {
 	desc string
 }
 
-func setdesc(_ *common.Pipe, state interface{}, params string) error {
+func setdesc(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
 	state.(*State).desc = params
-	return nil
+	return nil, nil
 }
 
-func getpin(pipe *common.Pipe, state interface{}, _ string) error {
-	s := bufio.NewScanner(os.Stdout)
-	fmt.Println(state.(*State).desc)
-	fmt.Print("Enter PIN: ")
-	if ok := s.Scan(); !ok {
+func getpin(pipe *common.Pipe, state interface{}, _ string) (*common.Error, error) {
+	// Stdin and stdout are used as a protocol channel so we have to talk
+	// to user using terminal directly.
+	tty, err := pinentry.OpenTTY("")
+	if err != nil {
 		return &common.Error{
 			Src: common.ErrSrcUnknown, Code: common.ErrGeneral,
 			SrcName: "system", Message: "I/O error",
-		}
+		}, nil
 	}
-	pipe.WriteData(s.Bytes())
-	return nil
+	defer tty.Close()
+
+	fmt.Fprintln(tty, state.(*State).desc)
+	fmt.Fprint(tty, "Enter PIN: ")
+	// Echo is disabled while PIN is typed.
+	pin, err := pinentry.ReadPasswordFromTTY(tty)
+	if err != nil {
+		return &common.Error{
+			Src: common.ErrSrcUnknown, Code: common.ErrGeneral,
+			SrcName: "system", Message: "I/O error",
+		}, nil
+	}
+	// Failure to write response means that connection is broken.
+	return nil, pipe.WriteData(pin)
 }
 
 func ExampleProtoInfo() {
 	pinentry := server.ProtoInfo{
 		Greeting: "Pleased to meet you",
 		Handlers: map[string]server.CommandHandler{
-			"SETDESC": server.CommandHandler(setdesc),
-			"GETPIN":  server.CommandHandler(getpin),
+			"SETDESC": setdesc,
+			"GETPIN":  getpin,
 		},
 		Help: map[string][]string{
 			"SETDESC": {
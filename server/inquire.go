@@ -17,45 +17,27 @@ import (
 //  C: D ...
 //  C: END
 //
-// Note: No OK or ERR sent after completion. You must report errors returned
-// by this function manually using WriteError or send OK.
-// This function can return common.Error, so you can do the following:
-//	 data, err := server.Inquire(scnr, pipe, ...)
-//	 if err != nil {
-//	     if e, ok := err.(common.Error); ok {
-//	  	   // Protocol error, report it to other peer (client).
-//	       pipe.WriteError(e)
-//	     } else {
-//	  	   // Internal error, do something else...
-//	     }
+// Note: No OK or ERR sent after completion. Protocol errors (i.e. inquiry
+// cancelled by client or MaxDataSize exceeded) are returned as perr and
+// I/O errors as err, same as CommandHandler results, so handler can just
+// return them:
+//	 data, perr, err := server.Inquire(pipe, []string{"KEYBLOCK"})
+//	 if perr != nil || err != nil {
+//	     return perr, err
 //	 }
-func Inquire(pipe *common.Pipe, keywords []string) (res map[string][]byte, err error) {
+func Inquire(pipe *common.Pipe, keywords []string) (res map[string][]byte, perr *common.Error, err error) {
 	res = make(map[string][]byte)
 
 	Logger.Println("Sending inquire group:", keywords)
 	for _, keyword := range keywords {
-		if err := pipe.WriteLine("INQUIRE", keyword); err != nil {
-			Logger.Println("... I/O error:", err)
-			return nil, err
-		}
-
-		data, err := pipe.ReadData()
+		data, err := pipe.Inquire(keyword)
 		if err != nil {
-			perr, ok := err.(*common.Error)
-
-			if ok {
-				if err := pipe.WriteError(*perr); err != nil {
-					Logger.Println("... I/O error:", err)
-					return nil, err
-				}
-				return nil, err
-			}
-
-			Logger.Println("... I/O error:", err)
-			return nil, err
+			Logger.Println("... inquiry failed:", err)
+			perr, err := splitError(err)
+			return nil, perr, err
 		}
 
 		res[keyword] = data
 	}
-	return res, nil
+	return res, nil, nil
 }
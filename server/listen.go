@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// ListenUnix creates Unix socket listener at path with specified
+// permissions, i.e. 0600 to prevent other users from connecting.
+//
+// Permissions are set using chmod after socket is created so they don't
+// depend on umask. Socket file left by previous (dead) server is removed,
+// but error is returned if some server still listens on it or path is not
+// a socket.
+//
+// Socket file is removed when listener is closed.
+func ListenUnix(path string, mode os.FileMode) (*net.UnixListener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.New("listen unix " + path + ": file exists and is not a socket")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return errors.New("listen unix " + path + ": socket is in use by another server")
+	}
+	Logger.Println("Removing stale socket", path)
+	return os.Remove(path)
+}
@@ -1,10 +1,17 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
 	"os"
 	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/foxcpp/go-assuan/common"
 )
@@ -14,16 +21,59 @@ import (
 // state object is useful to store arbitrary data between transactions in
 // single connection, it initialized from object returned by ProtoInfo.GetDefaultState.
 //
-// If handler returns *common.Error then this error will be sent to client. Otherwise error will be
-// logged and connection will be terminated.
-type CommandHandler func(pipe *common.Pipe, state interface{}, params string) error
+// Handler returns protocol error that should be sent to client and error
+// that should terminate connection (i.e. I/O error) separately. If both are
+// nil, OK is sent. If err is not nil, it is logged and connection is
+// terminated even if perr is set too.
+type CommandHandler func(pipe *common.Pipe, state interface{}, params string) (perr *common.Error, err error)
+
+// CommandHandler2 is same as CommandHandler but also gets name of the
+// command (in uppercase), so single function can handle several commands.
+// Use NamedHandler to register it in ProtoInfo.Handlers.
+type CommandHandler2 func(pipe *common.Pipe, state interface{}, cmd, params string) (*common.Error, error)
+
+// NamedHandler adapts CommandHandler2 to CommandHandler that should be
+// registered for command cmd, i.e.
+//
+//	for _, cmd := range []string{"SETDESC", "SETPROMPT"} {
+//		proto.Handlers[cmd] = server.NamedHandler(cmd, setText)
+//	}
+func NamedHandler(cmd string, h CommandHandler2) CommandHandler {
+	return func(pipe *common.Pipe, state interface{}, params string) (*common.Error, error) {
+		return h(pipe, state, cmd, params)
+	}
+}
+
+// splitError converts error returned by callbacks that use single error
+// result (ProtoInfo.SetOption, errors returned by common.Pipe.ReadData) to
+// the form used by CommandHandler: *common.Error is a protocol error, any
+// other error is fatal.
+func splitError(err error) (*common.Error, error) {
+	var perr *common.Error
+	if errors.As(err, &perr) {
+		// Typed nil *common.Error is treated as success.
+		return perr, nil
+	}
+	return nil, err
+}
 
 // ProtoInfo describes how to handle commands sent from client on server.
 // Usually there is only one instance of this structure per protocol (i.e. in global variable).
 type ProtoInfo struct {
 	// Sent together with first OK.
 	Greeting string
+	// If set, initial OK with greeting is not sent at all. This is not
+	// standard-compliant and client must be aware of it (see
+	// client.InitNoGreeting).
+	SuppressGreeting bool
 	// Key is command name (in uppercase), handler is called when specific command is received.
+	//
+	// Handlers for NOP, OPTION, HELP and RESET replace built-in
+	// implementations (OK for NOP is still sent with NopResponse). BYE
+	// can't be overridden. ECHO and "GETINFO status" are handled by
+	// handler only if built-in implementation is not enabled (see
+	// EnableEcho and HealthCheck). CANCEL and END have no built-in
+	// implementation.
 	Handlers map[string]CommandHandler
 	// Help strings for commands, spitted by \n.
 	Help map[string][]string
@@ -31,20 +81,113 @@ type ProtoInfo struct {
 	GetDefaultState func() interface{}
 	// Function that should set option passed via OPTION command or return an error.
 	//
-	// Error handling is done in way similar to CommandHandler (*common.Error's are
-	// sent to client, other errors terminate connection)
+	// *common.Error's are sent to client, other errors terminate
+	// connection.
 	SetOption func(state interface{}, key, val string) error
+	// Maximum amount of data (in bytes) accepted from client in response to
+	// single inquiry. Zero means no limit.
+	MaxDataSize int
+
+	// Called before every command (including built-in ones). If it returns
+	// non-nil error then command is not executed and error is sent to client.
+	PreCommand func(state interface{}, cmd, params string) *common.Error
+	// Called after every executed command with error returned by its
+	// handler (nil on success, fatal error takes precedence over protocol
+	// one). Not called for commands rejected by PreCommand.
+	PostCommand func(state interface{}, cmd string, err error)
+	// Called when client sends BYE, before OK is sent and connection is
+	// closed. Not called if connection is closed without BYE.
+	OnBye func(state interface{})
+
+	// If set, commands with parameters that are not valid UTF-8 (after
+	// unescaping) are rejected. Useful for text-oriented protocols, not
+	// enabled by default since Assuan parameters are arbitrary bytes.
+	ValidateUTF8 bool
+
+	// If set, "GETINFO status" command is handled by calling this function,
+	// OK is sent if it returns nil and ERR otherwise. Other GETINFO
+	// subcommands are passed to handler from Handlers as usual.
+	//
+	// This is intended to be used as a cheap liveness probe: probe connects,
+	// reads greeting, sends "GETINFO status" and checks whether response
+	// starts with OK. Most TCP health checkers (i.e. HAProxy's tcp-check)
+	// can do this directly, for HTTP-based ones you need a small proxy
+	// that uses client.Session.SimpleCmd("GETINFO", "status").
+	HealthCheck func() error
+
+	// If non-zero, commands that took longer than SlowThreshold to execute
+	// are logged (using Logger) together with their duration.
+	SlowThreshold time.Duration
+
+	// If set, JSON record is written for each executed command. Record
+	// contains time, remote address of client (if known), command name,
+	// length of parameters (never parameters themselves), result code and
+	// duration of execution in seconds.
+	//
+	// Result code is 0 for OK, Assuan error code for ERR and -1 if command
+	// caused connection to be dropped.
+	//
+	// Each record is written using single Write call, writes are serialized
+	// even if AuditWriter is shared by multiple connections.
+	AuditWriter io.Writer
+
+	// If set, built-in ECHO command is enabled. It sends its parameters
+	// back as data and is useful for testing of transports and escaping.
+	// Should not be enabled in production.
+	EnableEcho bool
+
+	// If non-zero, session is terminated after specified time regardless of
+	// activity and Serve returns ErrSessionExpired. Command in progress at
+	// this moment is interrupted if stream supports read deadlines and ERR
+	// is sent as its result.
+	MaxSessionDuration time.Duration
+
+	// Sent together with OK in response to NOP, i.e. to let peers that use
+	// NOP as a ping identify server. Empty by default.
+	NopResponse string
+
+	// If set, client must authenticate using AUTH command before any
+	// other commands (except BYE and NOP) are accepted, they are rejected
+	// with ErrForbidden until then. AUTH parameters are passed to this
+	// function, client is authenticated if it returns nil.
+	//
+	// Failed AUTH revokes previous authentication.
+	Authenticate func(state interface{}, params string) *common.Error
+
+	// Maximum number of OPTION commands accepted in single connection,
+	// further ones are rejected with ErrLimitReached. Only successful
+	// OPTION commands are counted. Zero means no limit.
+	MaxOptions int
+
+	// If non-zero, client can raise line length limit (common.MaxLineLen
+	// by default) up to this value using "OPTION line-length=N". Limit is
+	// changed for lines sent in both directions after OK is sent.
+	MaxNegotiatedLineLen int
+
+	// Execution time limits for individual commands (keys are command
+	// names in uppercase). If command takes longer, ERR with ErrTimeout
+	// is sent as its result. Handler is interrupted only if it waits for
+	// inquired data and stream supports read deadlines, in this case
+	// Serve returns ErrCommandTimeout since stream is left in unknown
+	// state. Otherwise timeout is detected after handler returns and
+	// session continues.
+	//
+	// Command with its own timeout is not interrupted by
+	// MaxSessionDuration, session is terminated after it completes
+	// instead.
+	CommandTimeouts map[string]time.Duration
 }
 
-var optRegexp = regexp.MustCompile(`^([\d\w\-]+)(?:[ =](.*))?$`)
+// Option can be sent as "name value", "name=value" or "name = value".
+var optRegexp = regexp.MustCompile(`^([\d\w\-]+)(?:(?:\s*=\s*|\s+)(.*))?$`)
 
+// splitOption splits OPTION parameters into name and value. params must be
+// already unescaped (ReadLine does that), so escaped '=' or spaces in value
+// are preserved as is.
 func splitOption(params string) (key string, val string, err *common.Error) {
 	groups := optRegexp.FindStringSubmatch(params)
 	if groups == nil {
-		return "", "", &common.Error{
-			Src: common.ErrSrcAssuan, Code: common.ErrAssInvValue,
-			SrcName: "assuan", Message: "invalid OPTION syntax",
-		}
+		return "", "", common.NewAssuanError(common.ErrAssInvValue, "invalid OPTION syntax")
 	}
 
 	return groups[1], groups[2], nil
@@ -52,190 +195,629 @@ func splitOption(params string) (key string, val string, err *common.Error) {
 
 // Serve function accepts incoming connection using specified protocol and initial state value.
 //
-// Serve returns only I/O errors or "other" errors returned by command handlers
-// (see CommandHandler doc).
+// Serve returns nil if session is finished normally, i.e. client sent BYE
+// or closed the connection (EOF is received while waiting for command).
+// Otherwise, it returns I/O errors (io.ErrUnexpectedEOF if connection is
+// closed during command execution, i.e. while handler waits for inquired
+// data) or "other" errors returned by command handlers (see CommandHandler
+// doc).
+//
+// Commands longer than line length limit are rejected with ERR (using
+// ErrAssLineTooLong code), session continues after that.
+//
+// Stream is not closed by Serve. If Serve returned error, response to the
+// last command might be sent only partially, so caller should close stream
+// instead of trying to reuse it.
 func Serve(stream io.ReadWriter, proto ProtoInfo) error {
-	Logger.Println("Accepted session")
-	pipe := common.New(stream)
+	return ServeContext(context.Background(), stream, proto)
+}
 
-	state := proto.GetDefaultState()
-	if err := pipe.WriteLine("OK", proto.Greeting); err != nil {
+// ServeContext is same as Serve but stops serving session when ctx is done
+// and returns ctx.Err().
+//
+// Command that is being executed when ctx is done is allowed to complete
+// and its response is sent to client. If stream implements
+// SetReadDeadline (as net.Conn does), waiting for next command is
+// interrupted, otherwise ServeContext returns only after next command is
+// received (it is not executed).
+//
+// Use signal.NotifyContext to stop serving on SIGTERM or SIGHUP.
+func ServeContext(ctx context.Context, stream io.ReadWriter, proto ProtoInfo) error {
+	rd, _ := stream.(readDeadliner)
+	return serve(ctx, stream, rd, proto)
+}
+
+// readDeadliner is implemented by net.Conn and *os.File.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// ServeOnce is same as Serve but returns after the first command is
+// executed and response to it is sent. Intended for stateless protocols
+// where client connects, runs single operation and disconnects.
+//
+// Caller is responsible for closing stream.
+func ServeOnce(stream io.ReadWriter, proto ProtoInfo) error {
+	sess, err := startSession(stream, proto)
+	if err != nil {
+		return err
+	}
+
+	cmd, params, err := sess.pipe.ReadLine()
+	if err == io.EOF {
+		Logger.Println("Client closed connection")
+		return nil
+	}
+	if lerr, ok := err.(*common.LineTooLongError); ok {
+		return sess.rejectLongLine(lerr)
+	}
+	if err != nil {
 		Logger.Println("I/O error, dropping session:", err)
 		return err
 	}
+	return sess.handleCmd(cmd, params)
+}
+
+// startSession creates session for stream and sends greeting.
+func startSession(stream io.ReadWriter, proto ProtoInfo) (*session, error) {
+	Logger.Println("Accepted session")
+	sess := &session{proto: proto, state: proto.GetDefaultState()}
+	pipe := common.NewPipe(sessionReader{s: sess, r: stream}, stream)
+	pipe.MaxDataSize = proto.MaxDataSize
+	sess.pipe = &pipe
+	if addr := pipe.RemoteAddr(); addr != nil {
+		sess.remoteAddr = addr.String()
+	}
+	if !proto.SuppressGreeting {
+		if err := pipe.WriteLine("OK", proto.Greeting); err != nil {
+			Logger.Println("I/O error, dropping session:", err)
+			return nil, err
+		}
+	}
+	return sess, nil
+}
+
+func serve(ctx context.Context, stream io.ReadWriter, rd readDeadliner, proto ProtoInfo) error {
+	sess, err := startSession(stream, proto)
+	if err != nil {
+		return err
+	}
+	pipe := sess.pipe
+
+	parentCtx := ctx
+	if proto.MaxSessionDuration != 0 {
+		sess.expiry = time.Now().Add(proto.MaxSessionDuration)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, sess.expiry)
+		defer cancel()
+	}
+	ctxErr := func() error {
+		if sess.expired() && parentCtx.Err() == nil {
+			return ErrSessionExpired
+		}
+		return ctx.Err()
+	}
+
+	// Read deadline is set only while we are waiting for command (or
+	// if session expired) so reading of inquired data by command handlers
+	// is not affected.
+	sess.rd = rd
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-stop:
+				return
+			}
+			sess.ioLck.Lock()
+			defer sess.ioLck.Unlock()
+			if sess.waiting || (sess.expired() && !sess.ownTimeout) {
+				sess.interruptRead()
+			}
+		}()
+	}
 
 	for {
+		sess.ioLck.Lock()
+		if ctx.Err() != nil {
+			sess.ioLck.Unlock()
+			err := ctxErr()
+			Logger.Println("Context is done, finishing session:", err)
+			return err
+		}
+		sess.waiting = true
+		sess.ioLck.Unlock()
+
 		cmd, params, err := pipe.ReadLine()
+
+		sess.ioLck.Lock()
+		sess.waiting = false
+		sess.ioLck.Unlock()
+
+		if ctx.Err() != nil {
+			err := ctxErr()
+			Logger.Println("Context is done, finishing session:", err)
+			return err
+		}
+		if err == io.EOF {
+			Logger.Println("Client closed connection")
+			return nil
+		}
+		if lerr, ok := err.(*common.LineTooLongError); ok {
+			if err := sess.rejectLongLine(lerr); err != nil {
+				return err
+			}
+			continue
+		}
 		if err != nil {
 			Logger.Println("I/O error, dropping session:", err)
 			return err
 		}
 
-		if err := handleCmd(&pipe, cmd, params, proto, &state); err != nil {
+		if err := sess.handleCmd(cmd, params); err != nil {
 			return err
 		}
+		if cmd == "BYE" {
+			return nil
+		}
 	}
 }
 
-func handleCmd(pipe *common.Pipe, cmd string, params string, proto ProtoInfo, state *interface{}) error {
-	switch cmd {
-	case "BYE":
-		if err := pipe.WriteLine("OK", ""); err != nil {
-			Logger.Println("... IO error, dropping session:", err)
-			return err
-		}
-		Logger.Println("Session finished")
-	case "NOP":
-		if err := pipe.WriteLine("OK", ""); err != nil {
-			Logger.Println("... IO error, dropping session:", err)
-			return err
+// session holds state of single connection served by Serve.
+type session struct {
+	pipe  *common.Pipe
+	proto ProtoInfo
+	state interface{}
+	// Empty if stream doesn't provide remote address.
+	remoteAddr string
+	// Zero if session duration is not limited.
+	expiry time.Time
+	// Set after successful AUTH, see ProtoInfo.Authenticate.
+	authenticated bool
+	// Number of successful OPTION commands, see ProtoInfo.MaxOptions.
+	options int
+
+	// Used to interrupt reads, nil if stream doesn't support deadlines.
+	rd readDeadliner
+
+	ioLck sync.Mutex
+	// Set while waiting for the next command.
+	waiting bool
+	// Set while executing command that has its own timeout (see
+	// ProtoInfo.CommandTimeouts).
+	ownTimeout bool
+	// Set if read from stream failed since command started, i.e. because
+	// it was interrupted.
+	readFailed bool
+}
+
+// sessionReader records failed reads, see session.readFailed.
+type sessionReader struct {
+	s *session
+	r io.Reader
+}
+
+func (r sessionReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if err != nil {
+		r.s.ioLck.Lock()
+		r.s.readFailed = true
+		r.s.ioLck.Unlock()
+	}
+	return n, err
+}
+
+// ErrSessionExpired is returned by Serve if session is terminated because
+// of ProtoInfo.MaxSessionDuration.
+var ErrSessionExpired = errors.New("session expired")
+
+// ErrCommandTimeout is returned by Serve if session is terminated because
+// command that took longer than allowed by ProtoInfo.CommandTimeouts was
+// interrupted.
+var ErrCommandTimeout = errors.New("command timed out")
+
+// rejectLongLine sends ERR in response to command that was too long (and
+// discarded by Pipe), session can continue after that.
+func (s *session) rejectLongLine(lerr *common.LineTooLongError) error {
+	Logger.Println("Too long line received:", lerr)
+	return s.sendError(lerr.Cmd, common.NewAssuanError(common.ErrAssLineTooLong, "line too long"))
+}
+
+// interruptRead makes pending and future reads from stream fail. Should be
+// called with ioLck held.
+func (s *session) interruptRead() {
+	if s.rd == nil {
+		return
+	}
+	if err := s.rd.SetReadDeadline(time.Now()); err != nil {
+		Logger.Println("Failed to interrupt read:", err)
+	}
+}
+
+// startCmdTimer starts timer that interrupts reads of command with its own
+// timeout.
+func (s *session) startCmdTimer(timeout time.Duration) *time.Timer {
+	s.ioLck.Lock()
+	defer s.ioLck.Unlock()
+	s.ownTimeout = true
+	s.readFailed = false
+	return time.AfterFunc(timeout, func() {
+		s.ioLck.Lock()
+		defer s.ioLck.Unlock()
+		if s.ownTimeout {
+			s.interruptRead()
 		}
-	case "OPTION":
-		if err := optionCmd(pipe, state, proto, params); err != nil {
-			Logger.Println("... IO error, dropping session:", err)
-			return err
+	})
+}
+
+// stopCmdTimer stops timer started by startCmdTimer. It reports whether
+// timer fired and if any read was interrupted by it. If not, reads are
+// restored so session can continue.
+func (s *session) stopCmdTimer(timer *time.Timer) (timedOut, interrupted bool) {
+	timedOut = !timer.Stop()
+	s.ioLck.Lock()
+	defer s.ioLck.Unlock()
+	s.ownTimeout = false
+	if !timedOut {
+		return false, false
+	}
+	if s.readFailed {
+		return true, true
+	}
+	if s.rd != nil {
+		if err := s.rd.SetReadDeadline(time.Time{}); err != nil {
+			Logger.Println("Failed to reset read deadline:", err)
+			return true, true
 		}
-	case "HELP":
-		if err := helpCmd(pipe, proto, params); err != nil {
-			Logger.Println("... IO error, dropping session:", err)
+	}
+	return true, false
+}
+
+func (s *session) expired() bool {
+	return !s.expiry.IsZero() && !time.Now().Before(s.expiry)
+}
+
+// handleCmd executes command and sends response (OK or ERR) to the client.
+func (s *session) handleCmd(cmd string, params string) error {
+	start := time.Now()
+	timeout, ownTimeout := s.proto.CommandTimeouts[cmd]
+	var timer *time.Timer
+	if ownTimeout {
+		timer = s.startCmdTimer(timeout)
+	}
+
+	perr, err := s.execCmd(cmd, params)
+
+	timedOut, interrupted := false, false
+	if ownTimeout {
+		// If handler's read was interrupted, stream is in unknown state,
+		// so session can't continue even if command completed.
+		timedOut, interrupted = s.stopCmdTimer(timer)
+	}
+	if timedOut && (interrupted || err == nil) {
+		// Command may be interrupted, so its result is not reliable.
+		Logger.Println("... command timed out")
+		perr, err = common.NewAssuanError(common.ErrTimeout, "command timed out"), nil
+	}
+	expired := !ownTimeout && s.expired()
+	if expired {
+		// Command may be interrupted, so its result is not reliable.
+		Logger.Println("... session expired during command")
+		perr, err = common.NewAssuanError(common.ErrTimeout, "session expired"), nil
+	}
+	s.audit(start, cmd, params, perr, err)
+
+	if err != nil {
+		return err
+	}
+	if expired || timedOut {
+		if err := s.sendError(cmd, perr); err != nil {
 			return err
 		}
-	case "RESET":
-		if proto.Handlers == nil {
-			proto.Handlers = make(map[string]CommandHandler)
+		if expired {
+			return ErrSessionExpired
 		}
-		if _, prs := proto.Handlers["RESET"]; !prs {
-			proto.Handlers["RESET"] = defaultResetCmd
+		if interrupted {
+			return ErrCommandTimeout
 		}
-		fallthrough
-	default:
-		Logger.Println("Protocol command received:", cmd)
-		hndlr, prs := proto.Handlers[cmd]
-		if !prs {
-			Logger.Println("... unknown command:", cmd)
-			if err := pipe.WriteError(common.Error{
-				Src: common.ErrSrcAssuan, Code: common.ErrAssUnknownCmd,
-				SrcName: "assuan", Message: "unknown IPC command",
-			}); err != nil {
-				Logger.Println("... IO error, dropping session:", err)
-				return err
-			}
-			return nil
+		return nil
+	}
+	if perr != nil {
+		return s.sendError(cmd, perr)
+	}
+
+	okParams := ""
+	if cmd == "NOP" {
+		okParams = s.proto.NopResponse
+	}
+	if err := s.pipe.WriteLine("OK", okParams); err != nil {
+		// Client may already received part of response (i.e. data) and
+		// now waits for rest of it, so session can't continue.
+		Logger.Println("... failed to send OK for", cmd+", dropping session:", err)
+		return err
+	}
+	return nil
+}
+
+// execCmd runs command with all hooks. It returns either *common.Error
+// that should be sent to client or any other error that should terminate
+// connection.
+func (s *session) execCmd(cmd string, params string) (*common.Error, error) {
+	if s.proto.ValidateUTF8 && !utf8.ValidString(params) {
+		Logger.Println("... parameters are not valid UTF-8")
+		return common.NewAssuanError(common.ErrAssInvValue, "parameters are not valid UTF-8"), nil
+	}
+
+	if s.proto.Authenticate != nil && !s.authenticated && cmd != "AUTH" && cmd != "BYE" && cmd != "NOP" {
+		Logger.Println("... command rejected: not authenticated")
+		return common.NewAssuanError(common.ErrForbidden, "authentication required"), nil
+	}
+
+	if s.proto.PreCommand != nil {
+		if perr := s.proto.PreCommand(s.state, cmd, params); perr != nil {
+			Logger.Println("... command rejected:", perr)
+			return perr, nil
 		}
+	}
 
-		err := hndlr(pipe, state, params)
-		if err != nil {
-			Logger.Println("... handler error:", err)
-
-			perr, ok := err.(*common.Error)
-			if ok {
-				if err := pipe.WriteError(*perr); err != nil {
-					Logger.Println("... IO error, dropping session:", err)
-					return err
-				}
-				return nil
-			} else {
-				return err
-			}
+	if cmd == "OPTION" && s.proto.MaxOptions != 0 && s.options >= s.proto.MaxOptions {
+		Logger.Println("... too many options")
+		return common.NewAssuanError(common.ErrLimitReached, "too many options"), nil
+	}
+
+	start := time.Now()
+	var perr *common.Error
+	var err error
+	if cmd == "AUTH" && s.proto.Authenticate != nil {
+		perr = s.authCmd(params)
+	} else {
+		perr, err = dispatchCmd(s.pipe, cmd, params, s.proto, s.state)
+	}
+	if cmd == "OPTION" && perr == nil && err == nil {
+		s.options++
+	}
+	if elapsed := time.Since(start); s.proto.SlowThreshold != 0 && elapsed > s.proto.SlowThreshold {
+		Logger.Println("WARNING: slow command:", cmd, "took", elapsed)
+	}
+
+	if s.proto.PostCommand != nil {
+		switch {
+		case err != nil:
+			s.proto.PostCommand(s.state, cmd, err)
+		case perr != nil:
+			s.proto.PostCommand(s.state, cmd, perr)
+		default:
+			s.proto.PostCommand(s.state, cmd, nil)
 		}
-		if err := pipe.WriteLine("OK", ""); err != nil {
-			Logger.Println("... IO error, dropping session:", err)
-			return err
+	}
+
+	if err != nil {
+		Logger.Println("... handler error, dropping session:", err)
+		if err == io.EOF {
+			// Don't let it look like normal session end.
+			err = io.ErrUnexpectedEOF
 		}
+		return nil, err
+	}
+	if perr != nil {
+		Logger.Println("... handler error:", perr)
+		return perr, nil
 	}
+	return nil, nil
+}
+
+func (s *session) authCmd(params string) *common.Error {
+	if perr := s.proto.Authenticate(s.state, params); perr != nil {
+		Logger.Println("... authentication failed:", perr)
+		s.authenticated = false
+		return perr
+	}
+	s.authenticated = true
 	return nil
 }
 
-func helpCmd(pipe *common.Pipe, proto ProtoInfo, params string) error {
+func (s *session) sendError(cmd string, perr *common.Error) error {
+	if err := s.pipe.WriteError(*perr); err != nil {
+		Logger.Println("... failed to send ERR for", cmd+", dropping session:", err)
+		return err
+	}
+	return nil
+}
+
+// dispatchCmd calls handler for command. It returns either *common.Error
+// that should be sent to client or any other error that should terminate
+// connection.
+func dispatchCmd(pipe *common.Pipe, cmd string, params string, proto ProtoInfo, state interface{}) (*common.Error, error) {
+	if _, prs := proto.Handlers[cmd]; prs && overridableCmds[cmd] {
+		return callHandler(pipe, cmd, params, proto, state)
+	}
+
+	switch cmd {
+	case "BYE":
+		Logger.Println("Session finished")
+		if proto.OnBye != nil {
+			proto.OnBye(state)
+		}
+		return nil, nil
+	case "NOP":
+		return nil, nil
+	case "OPTION":
+		return optionCmd(pipe, state, proto, params)
+	case "HELP":
+		return helpCmd(pipe, proto, params)
+	case "ECHO":
+		if proto.EnableEcho {
+			Logger.Println("Echo request")
+			return nil, pipe.WriteData([]byte(params))
+		}
+		return callHandler(pipe, cmd, params, proto, state)
+	case "GETINFO":
+		if params == "status" && proto.HealthCheck != nil {
+			return healthCheckCmd(proto), nil
+		}
+		return callHandler(pipe, cmd, params, proto, state)
+	case "RESET":
+		// Handlers map is shared between connections, so default handler
+		// is called directly instead of being added to it.
+		return defaultResetCmd(pipe, state, params)
+	default:
+		return callHandler(pipe, cmd, params, proto, state)
+	}
+}
+
+// overridableCmds is a set of built-in commands that can be replaced by
+// ProtoInfo.Handlers entries.
+var overridableCmds = map[string]bool{"NOP": true, "OPTION": true, "HELP": true, "RESET": true}
+
+func callHandler(pipe *common.Pipe, cmd string, params string, proto ProtoInfo, state interface{}) (*common.Error, error) {
+	Logger.Println("Protocol command received:", cmd)
+	hndlr, prs := proto.Handlers[cmd]
+	if !prs {
+		Logger.Println("... unknown command:", cmd)
+		return common.NewAssuanError(common.ErrAssUnknownCmd, "unknown IPC command"), nil
+	}
+
+	return hndlr(pipe, state, params)
+}
+
+// healthCheckCmd runs ProtoInfo.HealthCheck. Failed check is always
+// reported to client and never terminates connection.
+func healthCheckCmd(proto ProtoInfo) *common.Error {
+	err := proto.HealthCheck()
+	if err == nil {
+		return nil
+	}
+	Logger.Println("Health check failed:", err)
+	var perr *common.Error
+	if errors.As(err, &perr) && perr != nil {
+		return perr
+	}
+	return common.NewAssuanError(common.ErrNotOperational, err.Error())
+}
+
+var builtinCmds = []string{"NOP", "OPTION", "CANCEL", "BYE", "RESET", "END", "HELP"}
+
+func isBuiltin(cmd string) bool {
+	for _, builtin := range builtinCmds {
+		if cmd == builtin {
+			return true
+		}
+	}
+	return false
+}
+
+func helpCmd(pipe *common.Pipe, proto ProtoInfo, params string) (*common.Error, error) {
 	Logger.Println("Help request")
 
 	if len(params) != 0 {
 		// Help requested for command.
 		helpStrs, prs := proto.Help[params]
 		if !prs {
-			Logger.Println("Help requested for unknown command:", params)
-			if err := pipe.WriteError(common.Error{
-				Src: common.ErrSrcAssuan, Code: common.ErrNotFound,
-				SrcName: "assuan", Message: "not found",
-			}); err != nil {
-				return err
-			}
-		} else {
-			for _, helpStr := range helpStrs {
-				if err := pipe.WriteComment(helpStr); err != nil {
-					return err
-				}
-			}
-			if err := pipe.WriteLine("OK", ""); err != nil {
-				return err
+			if _, prs := proto.Handlers[params]; prs || isBuiltin(params) {
+				// Command exists but has no help text.
+				return nil, nil
 			}
+			Logger.Println("Help requested for unknown command:", params)
+			return common.NewAssuanError(common.ErrNotFound, "not found"), nil
 		}
-	} else {
-		// Just HELP, print commands.
-		for _, cmd := range [8]string{"NOP", "OPTION", "CANCEL", "BYE", "RESET", "END", "HELP"} {
-			if err := pipe.WriteComment(cmd); err != nil {
-				return err
+		for _, helpStr := range helpStrs {
+			if err := pipe.WriteComment(helpStr); err != nil {
+				return nil, err
 			}
 		}
-		for k := range proto.Handlers {
-			if err := pipe.WriteComment(k); err != nil {
-				return err
-			}
+		return nil, nil
+	}
+
+	// Just HELP, print commands.
+	for _, cmd := range builtinCmds {
+		if err := pipe.WriteComment(cmd); err != nil {
+			return nil, err
 		}
-		if err := pipe.WriteLine("OK", ""); err != nil {
-			return err
+	}
+	for k := range proto.Handlers {
+		if isBuiltin(k) {
+			// Overridden built-in, already listed.
+			continue
+		}
+		if err := pipe.WriteComment(k); err != nil {
+			return nil, err
 		}
 	}
-	return nil
+	return nil, nil
 }
 
-func defaultResetCmd(pipe *common.Pipe, _ interface{}, _ string) error {
+func defaultResetCmd(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
 	Logger.Println("Session reset")
-	return nil
+	return nil, nil
 }
 
-func optionCmd(pipe *common.Pipe, state interface{}, proto ProtoInfo, params string) error {
+func optionCmd(pipe *common.Pipe, state interface{}, proto ProtoInfo, params string) (*common.Error, error) {
 	Logger.Println("Option set request:", params)
+	key, value, serr := splitOption(params)
+	if serr == nil && key == "line-length" && proto.MaxNegotiatedLineLen != 0 {
+		return lineLengthOpt(pipe, proto, value), nil
+	}
 	if proto.SetOption == nil {
 		Logger.Println("... no options supported in this protocol")
-		if err := pipe.WriteError(common.Error{
-			Src: common.ErrSrcAssuan, Code: common.ErrNotImplemented,
-			SrcName: "assuan", Message: "not implemented",
-		}); err != nil {
-			return err
-		}
-		return nil
+		return common.NewAssuanError(common.ErrNotImplemented, "not implemented"), nil
 	}
-	key, value, serr := splitOption(params)
 	if serr != nil {
 		Logger.Println("... malformed request: ", serr)
-		if err := pipe.WriteError(*serr); err != nil {
-			return err
-		}
-		return nil
+		return serr, nil
 	}
-	err := proto.SetOption(state, key, value)
-	if err != nil {
-		Logger.Println("... handler error:", err)
+	return splitError(proto.SetOption(state, key, value))
+}
 
-		perr, ok := err.(*common.Error)
-		if ok {
-			if err := pipe.WriteError(*perr); err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
+func lineLengthOpt(pipe *common.Pipe, proto ProtoInfo, value string) *common.Error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < common.MaxLineLen {
+		return common.NewAssuanError(common.ErrAssInvValue, "invalid line length")
 	}
-	if err := pipe.WriteLine("OK", ""); err != nil {
-		return err
+	if n > proto.MaxNegotiatedLineLen {
+		return common.NewAssuanError(common.ErrAssInvValue, "line length is too big")
+	}
+	if err := pipe.SetMaxLineLen(n); err != nil {
+		return common.NewAssuanError(common.ErrAssInvValue, err.Error())
 	}
+	Logger.Println("... line length limit changed to", n)
 	return nil
 }
 
+// RecordOptions returns function suitable for use as ProtoInfo.SetOption
+// that accepts any option and stores its value in m.
+//
+// Writes to m are serialized, but m must not be accessed by caller while
+// sessions using returned function are being served.
+func RecordOptions(m map[string]string) func(state interface{}, key, val string) error {
+	var lck sync.Mutex
+	return func(_ interface{}, key, val string) error {
+		lck.Lock()
+		defer lck.Unlock()
+		m[key] = val
+		return nil
+	}
+}
+
+// Streams used by ServeStdin and ServeStdinContext, replaced by tests.
+var stdin, stdout = os.Stdin, os.Stdout
+
 // ServeStdin is same as Serve but uses stdin and stdout as communication channel.
+//
+// As with Serve, nil is returned if client sent BYE or closed stdin, so
+// process started by client can use it to decide on exit code.
 func ServeStdin(proto ProtoInfo) error {
-	return Serve(common.ReadWriter{Reader: os.Stdin, Writer: os.Stdout}, proto)
+	return Serve(common.ReadWriter{Reader: stdin, Writer: stdout}, proto)
+}
+
+// ServeStdinContext is same as ServeContext but uses stdin and stdout as
+// communication channel.
+//
+// Waiting for command is interrupted only if stdin supports deadlines
+// (i.e. it is a pipe, not a regular file).
+func ServeStdinContext(ctx context.Context, proto ProtoInfo) error {
+	return serve(ctx, common.ReadWriter{Reader: stdin, Writer: stdout}, stdin, proto)
 }
 
 // Listener is a minimal interface implemented by net.UnixListener and net.TCPListener.
@@ -245,15 +827,69 @@ type Listener interface {
 
 // ServeNet is same as Server but accepts connections (net.Conn) using passed
 // listener and launches goroutine to serve each.
-// This function will return if Accept() fails.
+// Temporary Accept() errors (i.e. EMFILE) are retried after a delay, this
+// function returns on any other Accept() error (i.e. closed listener).
+//
+// Use NetServer if ProtoInfo needs to be replaced while serving.
 func ServeNet(listener Listener, proto ProtoInfo) error {
+	return NewNetServer(proto).Serve(listener)
+}
+
+// acceptRetryDelay returns delay before next Accept() call after temporary
+// error, prev is delay used after previous one (zero if it succeeded).
+func acceptRetryDelay(prev time.Duration) time.Duration {
+	const maxDelay = time.Second
+	if prev == 0 {
+		return 5 * time.Millisecond
+	}
+	if prev*2 > maxDelay {
+		return maxDelay
+	}
+	return prev * 2
+}
+
+// NetServer serves connections accepted from listener, like ServeNet, but
+// allows to replace ProtoInfo used for new connections while serving.
+type NetServer struct {
+	// Holds ProtoInfo.
+	proto atomic.Value
+}
+
+// NewNetServer creates NetServer that initially uses specified ProtoInfo.
+func NewNetServer(proto ProtoInfo) *NetServer {
+	s := &NetServer{}
+	s.proto.Store(proto)
+	return s
+}
+
+// ReloadProto replaces ProtoInfo used for connections accepted after call.
+// Connections that are already being served continue using old ProtoInfo
+// until they are closed.
+//
+// Intended to be used for reloading of configuration (i.e. on SIGHUP)
+// without dropping clients. Safe to call concurrently with Serve.
+func (s *NetServer) ReloadProto(proto ProtoInfo) {
+	s.proto.Store(proto)
+}
+
+// Serve accepts connections using passed listener and launches goroutine
+// to serve each. Accept() errors are handled same way as in ServeNet.
+func (s *NetServer) Serve(listener Listener) error {
+	var delay time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			Logger.Println("Listener fail:", err)
-			continue
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				delay = acceptRetryDelay(delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
 		}
+		delay = 0
 		Logger.Println("Received remote connection on", conn.LocalAddr(), "from", conn.RemoteAddr())
+		proto := s.proto.Load().(ProtoInfo)
 		go func() {
 			defer conn.Close()
 			if err := Serve(conn, proto); err != nil {
@@ -261,5 +897,4 @@ func ServeNet(listener Listener, proto ProtoInfo) error {
 			}
 		}()
 	}
-	return nil
 }
@@ -2,9 +2,20 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/foxcpp/go-assuan/common"
 )
@@ -18,9 +29,9 @@ D BAZ
 END
 `
 	pipe := common.NewPipe(strings.NewReader(sample), ioutil.Discard)
-	data, err := Inquire(&pipe, []string{"foo", "bar", "baz"})
-	if err != nil {
-		t.Error("Unexpected Inquire error:", err)
+	data, perr, err := Inquire(&pipe, []string{"foo", "bar", "baz"})
+	if perr != nil || err != nil {
+		t.Error("Unexpected Inquire error:", perr, err)
 		t.FailNow()
 	}
 
@@ -38,12 +49,99 @@ END
 	}
 }
 
+func TestInquire_Cancel(t *testing.T) {
+	srvConn, clConn := net.Pipe()
+	defer clConn.Close()
+	go func() {
+		defer srvConn.Close()
+		Serve(srvConn, ProtoInfo{
+			GetDefaultState: func() interface{} { return nil },
+			Handlers: map[string]CommandHandler{
+				"SETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+					_, perr, err := Inquire(pipe, []string{"DATA"})
+					return perr, err
+				},
+			},
+		})
+	}()
+
+	pipe := common.New(clConn)
+	expect := func(lines ...string) {
+		t.Helper()
+		for _, line := range lines {
+			cmd, _, err := pipe.ReadLine()
+			if err != nil {
+				t.Fatal("Unexpected ReadLine error:", err)
+			}
+			if cmd != line {
+				t.Fatalf("Expected %s, got %s", line, cmd)
+			}
+		}
+	}
+	send := func(cmd string) {
+		t.Helper()
+		if err := pipe.WriteLine(cmd, ""); err != nil {
+			t.Fatal("Unexpected WriteLine error:", err)
+		}
+	}
+
+	expect("OK")
+	send("SETDATA")
+	expect("INQUIRE")
+	send("CAN")
+	expect("ERR")
+	// Session is still usable.
+	send("NOP")
+	expect("OK")
+}
+
+func TestInquireLarge(t *testing.T) {
+	// ~2 MiB sent using D lines of 900 bytes each.
+	chunk := strings.Repeat("A", 450) + strings.Repeat("%25", 150)
+	sample := strings.Repeat("D "+chunk+"\n", 2500) + "END\n"
+	expected := strings.Repeat(strings.Repeat("A", 450)+strings.Repeat("%", 150), 2500)
+
+	t.Run("no limit", func(t *testing.T) {
+		pipe := common.NewPipe(strings.NewReader(sample), ioutil.Discard)
+		data, perr, err := Inquire(&pipe, []string{"foo"})
+		if perr != nil || err != nil {
+			t.Error("Unexpected Inquire error:", perr, err)
+			t.FailNow()
+		}
+		if string(data["foo"]) != expected {
+			t.Error("Incorrect data read, length:", len(data["foo"]))
+		}
+	})
+	t.Run("limit exceeded", func(t *testing.T) {
+		pipe := common.NewPipe(strings.NewReader(sample+"NOP\n"), ioutil.Discard)
+		pipe.MaxDataSize = 1024 * 1024
+		_, perr, err := Inquire(&pipe, []string{"foo"})
+		if perr == nil || err != nil {
+			t.Error("Expected protocol error, got:", perr, err)
+			t.FailNow()
+		}
+		if perr.Code != common.ErrAssTooMuchData {
+			t.Error("Unexpected error code:", perr.Code)
+		}
+
+		// Remaining data should be consumed.
+		cmd, _, err := pipe.ReadLine()
+		if err != nil {
+			t.Error("Unexpected ReadLine error:", err)
+			t.FailNow()
+		}
+		if cmd != "NOP" {
+			t.Error("Stream is desynchronized, got:", cmd)
+		}
+	})
+}
+
 func TestHandleCmd(t *testing.T) {
 	t.Run("BYE cmd", func(t *testing.T) {
 		buf := bytes.Buffer{}
 		pipe := common.NewPipe(nil, &buf)
 
-		if err := handleCmd(&pipe, "BYE", "", ProtoInfo{}, nil); err != nil {
+		if err := (&session{pipe: &pipe, proto: ProtoInfo{}, state: nil}).handleCmd("BYE", ""); err != nil {
 			t.Error("Unexpected handleCmd error:", err)
 			t.FailNow()
 		}
@@ -51,13 +149,70 @@ func TestHandleCmd(t *testing.T) {
 			t.Error("Response to BYE is not OK:", buf.String())
 		}
 	})
+	t.Run("BYE cmd (OnBye)", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+
+		var byeState interface{}
+		proto := ProtoInfo{OnBye: func(state interface{}) {
+			if buf.Len() != 0 {
+				t.Error("OnBye called after response:", buf.String())
+			}
+			byeState = state
+		}}
+		if err := (&session{pipe: &pipe, proto: proto, state: "foobar"}).handleCmd("BYE", ""); err != nil {
+			t.Fatal("Unexpected handleCmd error:", err)
+		}
+		if byeState != "foobar" {
+			t.Error("OnBye not called with session state:", byeState)
+		}
+		if buf.String() != "OK\n" {
+			t.Error("Response to BYE is not OK:", buf.String())
+		}
+	})
+	t.Run("NOP cmd", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+
+		if err := (&session{pipe: &pipe, proto: ProtoInfo{NopResponse: "test server 1.0"}, state: nil}).handleCmd("NOP", ""); err != nil {
+			t.Error("Unexpected handleCmd error:", err)
+			t.FailNow()
+		}
+		if buf.String() != "OK test server 1.0\n" {
+			t.Error("Wrong response to NOP:", buf.String())
+		}
+	})
+	t.Run("NOP cmd (overridden)", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+		proto := ProtoInfo{Handlers: map[string]CommandHandler{
+			"NOP": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return nil, pipe.WriteStatus("PONG", "")
+			},
+		}}
+
+		if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("NOP", ""); err != nil {
+			t.Fatal("Unexpected handleCmd error:", err)
+		}
+		if buf.String() != "S PONG\nOK\n" {
+			t.Error("Wrong response to overridden NOP:", buf.String())
+		}
+
+		buf.Reset()
+		if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("HELP", ""); err != nil {
+			t.Fatal("Unexpected handleCmd error:", err)
+		}
+		if strings.Count(buf.String(), "# NOP\n") != 1 {
+			t.Error("Overridden NOP is not listed exactly once:", buf.String())
+		}
+	})
 	t.Run("RESET cmd (default handler)", func(t *testing.T) {
 		buf := bytes.Buffer{}
 		pipe := common.NewPipe(nil, &buf)
 
 		state := interface{}("foobar")
 
-		if err := handleCmd(&pipe, "RESET", "", ProtoInfo{}, &state); err != nil {
+		if err := (&session{pipe: &pipe, proto: ProtoInfo{}, state: state}).handleCmd("RESET", ""); err != nil {
 			t.Error("Unexpected handleCmd error:", err)
 			t.FailNow()
 		}
@@ -66,8 +221,15 @@ func TestHandleCmd(t *testing.T) {
 		}
 	})
 	t.Run("HELP cmd", helpTest)
+	t.Run("hooks", hooksTest)
+	t.Run("UTF-8 validation", utf8Test)
+	t.Run("health check", healthCheckTest)
+	t.Run("slow command", slowCmdTest)
+	t.Run("ECHO cmd", echoTest)
+	t.Run("audit", auditTest)
 	t.Run("OPTION cmd", optionsTest)
 	t.Run("custom cmd", customCmdTest)
+	t.Run("AUTH cmd", authTest)
 }
 
 func helpTest(t *testing.T) {
@@ -75,7 +237,7 @@ func helpTest(t *testing.T) {
 		buf := bytes.Buffer{}
 		pipe := common.NewPipe(nil, &buf)
 
-		if err := handleCmd(&pipe, "HELP", "", ProtoInfo{}, nil); err != nil {
+		if err := (&session{pipe: &pipe, proto: ProtoInfo{}, state: nil}).handleCmd("HELP", ""); err != nil {
 			t.Error("Unexpected handleCmd error:", err)
 			t.FailNow()
 		}
@@ -85,7 +247,7 @@ func helpTest(t *testing.T) {
 				continue
 			}
 			if !strings.HasPrefix(line, "#") && line != "OK" {
-				t.Error("Response contains non-comment lines other than OK:", "'" + line + "'")
+				t.Error("Response contains non-comment lines other than OK:", "'"+line+"'")
 				t.Error(buf.String())
 				t.FailNow()
 			}
@@ -95,7 +257,7 @@ func helpTest(t *testing.T) {
 		buf := bytes.Buffer{}
 		pipe := common.NewPipe(nil, &buf)
 
-		if err := handleCmd(&pipe, "HELP", "CCMD", ProtoInfo{}, nil); err != nil {
+		if err := (&session{pipe: &pipe, proto: ProtoInfo{}, state: nil}).handleCmd("HELP", "CCMD"); err != nil {
 			t.Error("Unexpected handleCmd error:", err)
 			t.FailNow()
 		}
@@ -111,7 +273,7 @@ func helpTest(t *testing.T) {
 
 		proto.Help = make(map[string][]string)
 		proto.Help["CCMD"] = []string{"help string"}
-		if err := handleCmd(&pipe, "HELP", "CCMD", proto, nil); err != nil {
+		if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("HELP", "CCMD"); err != nil {
 			t.Error("Unexpected handleCmd error:", err)
 			t.FailNow()
 		}
@@ -120,6 +282,25 @@ func helpTest(t *testing.T) {
 			t.Error(buf.String())
 		}
 	})
+	t.Run("long help line", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+		proto := ProtoInfo{}
+
+		proto.Help = map[string][]string{"CCMD": {strings.Repeat("long help ", 150)}}
+		if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("HELP", "CCMD"); err != nil {
+			t.Fatal("Unexpected handleCmd error:", err)
+		}
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		if len(lines) < 3 || lines[len(lines)-1] != "OK" {
+			t.Fatal("Help line is not wrapped:", buf.String())
+		}
+		for _, line := range lines[:len(lines)-1] {
+			if !strings.HasPrefix(line, "# ") || len(line)+1 > common.MaxLineLen {
+				t.Errorf("Invalid help line: %q", line)
+			}
+		}
+	})
 }
 
 func customCmdTest(t *testing.T) {
@@ -127,7 +308,7 @@ func customCmdTest(t *testing.T) {
 		buf := bytes.Buffer{}
 		pipe := common.NewPipe(nil, &buf)
 
-		if err := handleCmd(&pipe, "CCMD", "test", ProtoInfo{}, nil); err != nil {
+		if err := (&session{pipe: &pipe, proto: ProtoInfo{}, state: nil}).handleCmd("CCMD", "test"); err != nil {
 			t.Error("Unexpected handleCmd error:", err)
 			t.FailNow()
 		}
@@ -142,14 +323,14 @@ func customCmdTest(t *testing.T) {
 
 		proto := ProtoInfo{}
 		proto.Handlers = make(map[string]CommandHandler)
-		proto.Handlers["CCMD"] = func(_ *common.Pipe, _ interface{}, _ string) error {
+		proto.Handlers["CCMD"] = func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
 			return &common.Error{
 				Src: common.ErrSrcAssuan, Code: common.ErrAssUnknownCmd,
 				SrcName: "assuan", Message: "TEST ERROR",
-			}
+			}, nil
 		}
 
-		if err := handleCmd(&pipe, "CCMD", "", proto, nil); err != nil {
+		if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("CCMD", ""); err != nil {
 			t.Error("Unexpected handleCmd error:", err)
 			t.FailNow()
 		}
@@ -158,14 +339,118 @@ func customCmdTest(t *testing.T) {
 			t.Error(buf.String())
 		}
 	})
+	t.Run("nil common.Error from cmd handler", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+
+		check := func() *common.Error { return nil }
+		proto := ProtoInfo{Handlers: map[string]CommandHandler{
+			"CCMD": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return check(), nil
+			},
+		}}
+
+		if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("CCMD", ""); err != nil {
+			t.Fatal("Unexpected handleCmd error:", err)
+		}
+		if buf.String() != "OK\n" {
+			t.Errorf("Wrong response: %q", buf.String())
+		}
+	})
+	t.Run("return paths", func(t *testing.T) {
+		fatalErr := errors.New("broken")
+		proto := ProtoInfo{Handlers: map[string]CommandHandler{
+			"OK": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return nil, nil
+			},
+			"PROTO": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return common.NewAssuanError(common.ErrAssInvValue, "bad value"), nil
+			},
+			"FATAL": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return nil, fatalErr
+			},
+			"FATALPROTO": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return nil, common.NewAssuanError(common.ErrAssReadError, "read failed")
+			},
+			"BOTH": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return common.NewAssuanError(common.ErrAssInvValue, "bad value"), fatalErr
+			},
+		}}
+
+		for _, c := range []struct {
+			cmd      string
+			fatal    bool
+			response string
+		}{
+			{"OK", false, "OK\n"},
+			{"PROTO", false, "ERR 251658501 bad value <assuan>\n"},
+			{"FATAL", true, ""},
+			{"FATALPROTO", true, ""},
+			{"BOTH", true, ""},
+		} {
+			buf := bytes.Buffer{}
+			pipe := common.NewPipe(nil, &buf)
+
+			err := (&session{pipe: &pipe, proto: proto}).handleCmd(c.cmd, "")
+			if c.fatal != (err != nil) {
+				t.Errorf("%s: unexpected handleCmd result: %v", c.cmd, err)
+			}
+			if buf.String() != c.response {
+				t.Errorf("%s: wrong response: %q", c.cmd, buf.String())
+			}
+		}
+	})
+	t.Run("NamedHandler", func(t *testing.T) {
+		pipe := common.NewPipe(nil, ioutil.Discard)
+
+		values := map[string]string{}
+		setValue := func(_ *common.Pipe, _ interface{}, cmd, params string) (*common.Error, error) {
+			values[cmd] = params
+			return nil, nil
+		}
+		proto := ProtoInfo{Handlers: map[string]CommandHandler{}}
+		for _, cmd := range []string{"SETA", "SETB"} {
+			proto.Handlers[cmd] = NamedHandler(cmd, setValue)
+		}
+
+		sess := session{pipe: &pipe, proto: proto}
+		if err := sess.handleCmd("SETA", "1"); err != nil {
+			t.Fatal("Unexpected handleCmd error:", err)
+		}
+		if err := sess.handleCmd("SETB", "2"); err != nil {
+			t.Fatal("Unexpected handleCmd error:", err)
+		}
+		if !reflect.DeepEqual(values, map[string]string{"SETA": "1", "SETB": "2"}) {
+			t.Errorf("Wrong command names passed: %v", values)
+		}
+	})
 }
 
 func optionsTest(t *testing.T) {
+	t.Run("line-length", func(t *testing.T) {
+		proto := ProtoInfo{MaxNegotiatedLineLen: 4096}
+		for params, ok := range map[string]bool{
+			"line-length=2000":   true,
+			"line-length=10":     false,
+			"line-length=100000": false,
+			"line-length=abc":    false,
+		} {
+			buf := bytes.Buffer{}
+			pipe := common.NewPipe(nil, &buf)
+
+			if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("OPTION", params); err != nil {
+				t.Fatal("Unexpected handleCmd error:", err)
+			}
+			if ok != (buf.String() == "OK\n") || !ok && !strings.HasPrefix(buf.String(), "ERR") {
+				t.Errorf("Wrong response to OPTION %s: %q", params, buf.String())
+			}
+		}
+	})
 	t.Run("no OPTION support", func(t *testing.T) {
 		buf := bytes.Buffer{}
 		pipe := common.NewPipe(nil, &buf)
 
-		if err := handleCmd(&pipe, "OPTION", "a 2", ProtoInfo{}, nil); err != nil {
+		if err := (&session{pipe: &pipe, proto: ProtoInfo{}, state: nil}).handleCmd("OPTION", "a 2"); err != nil {
 			t.Error("Unexpected handleCmd error:", err)
 			t.FailNow()
 		}
@@ -186,7 +471,7 @@ func optionsTest(t *testing.T) {
 			}
 		}
 
-		if err := handleCmd(&pipe, "OPTION", "a 2", proto, nil); err != nil {
+		if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("OPTION", "a 2"); err != nil {
 			t.Error("Unexpected handleCmd error:", err)
 			t.FailNow()
 		}
@@ -207,7 +492,7 @@ func optionsTest(t *testing.T) {
 			return nil
 		}
 
-		if err := handleCmd(&pipe, "OPTION", "a 2", proto, nil); err != nil {
+		if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("OPTION", "a 2"); err != nil {
 			t.Error("Unexpected handleCmd error:", err)
 			t.FailNow()
 		}
@@ -220,4 +505,1083 @@ func optionsTest(t *testing.T) {
 			t.Errorf("Mismatched key-value: wanted %s/%s, got %s/%s", "a", "2", key, val)
 		}
 	})
+	t.Run("escaped value", func(t *testing.T) {
+		opts := map[string]string{}
+		proto := ProtoInfo{SetOption: RecordOptions(opts)}
+		buf := bytes.Buffer{}
+		in := "OPTION ttyname=/dev/pts/with%20space\n" +
+			"OPTION putenv FOO%3Dbar baz\n" +
+			"OPTION lc-ctype = C\n"
+		pipe := common.NewPipe(strings.NewReader(in), &buf)
+		sess := session{pipe: &pipe, proto: proto}
+
+		for i := 0; i < 3; i++ {
+			cmd, params, err := pipe.ReadLine()
+			if err != nil {
+				t.Fatal("Unexpected ReadLine error:", err)
+			}
+			if err := sess.handleCmd(cmd, params); err != nil {
+				t.Fatal("Unexpected handleCmd error:", err)
+			}
+		}
+		if strings.Contains(buf.String(), "ERR") {
+			t.Fatal("OPTION command failed:", buf.String())
+		}
+
+		expected := map[string]string{
+			"ttyname":  "/dev/pts/with space",
+			"putenv":   "FOO=bar baz",
+			"lc-ctype": "C",
+		}
+		if !reflect.DeepEqual(opts, expected) {
+			t.Errorf("Wrong options recorded: %v", opts)
+		}
+	})
+	t.Run("MaxOptions", func(t *testing.T) {
+		opts := map[string]string{}
+		proto := ProtoInfo{SetOption: RecordOptions(opts), MaxOptions: 2}
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+		sess := session{pipe: &pipe, proto: proto}
+
+		for _, params := range []string{"a 1", "b 2", "c 3"} {
+			if err := sess.handleCmd("OPTION", params); err != nil {
+				t.Fatal("Unexpected handleCmd error:", err)
+			}
+		}
+		expectedErr := "ERR " + strconv.Itoa(common.MakeErrCode(common.ErrSrcAssuan, common.ErrLimitReached))
+		if !strings.HasPrefix(buf.String(), "OK\nOK\n"+expectedErr) {
+			t.Error("Option over limit is not rejected:", buf.String())
+		}
+		if !reflect.DeepEqual(opts, map[string]string{"a": "1", "b": "2"}) {
+			t.Errorf("Wrong options recorded: %v", opts)
+		}
+	})
+	t.Run("RecordOptions", func(t *testing.T) {
+		opts := map[string]string{}
+		proto := ProtoInfo{SetOption: RecordOptions(opts)}
+		pipe := common.NewPipe(nil, ioutil.Discard)
+		sess := session{pipe: &pipe, proto: proto}
+
+		for _, params := range []string{"ttyname /dev/pts/1", "lc-ctype=C", "no-grab"} {
+			if err := sess.handleCmd("OPTION", params); err != nil {
+				t.Fatal("Unexpected handleCmd error:", err)
+			}
+		}
+
+		expected := map[string]string{"ttyname": "/dev/pts/1", "lc-ctype": "C", "no-grab": ""}
+		if !reflect.DeepEqual(opts, expected) {
+			t.Errorf("Wrong options recorded: %v", opts)
+		}
+	})
+}
+
+func hooksTest(t *testing.T) {
+	t.Run("invocation order", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+
+		calls := []string{}
+		proto := ProtoInfo{}
+		proto.Handlers = map[string]CommandHandler{
+			"CCMD": func(_ *common.Pipe, state interface{}, params string) (*common.Error, error) {
+				calls = append(calls, "handler "+state.(string)+" "+params)
+				return nil, nil
+			},
+		}
+		proto.PreCommand = func(state interface{}, cmd, params string) *common.Error {
+			calls = append(calls, "pre "+state.(string)+" "+cmd+" "+params)
+			return nil
+		}
+		proto.PostCommand = func(state interface{}, cmd string, err error) {
+			calls = append(calls, "post "+state.(string)+" "+cmd)
+			if err != nil {
+				t.Error("Unexpected error passed to PostCommand:", err)
+			}
+		}
+
+		if err := (&session{pipe: &pipe, proto: proto, state: "state"}).handleCmd("CCMD", "test"); err != nil {
+			t.Error("Unexpected handleCmd error:", err)
+			t.FailNow()
+		}
+		if buf.String() != "OK\n" {
+			t.Error("Response to CCMD is not OK:", buf.String())
+		}
+
+		expected := []string{"pre state CCMD test", "handler state test", "post state CCMD"}
+		if strings.Join(calls, "|") != strings.Join(expected, "|") {
+			t.Error("Hooks called in wrong order:", calls)
+		}
+	})
+	t.Run("rejected by PreCommand", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+
+		handlerCalled, postCalled := false, false
+		proto := ProtoInfo{}
+		proto.Handlers = map[string]CommandHandler{
+			"CCMD": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				handlerCalled = true
+				return nil, nil
+			},
+		}
+		proto.PreCommand = func(_ interface{}, _, _ string) *common.Error {
+			return &common.Error{
+				Src: common.ErrSrcAssuan, Code: common.ErrForbidden,
+				SrcName: "assuan", Message: "forbidden",
+			}
+		}
+		proto.PostCommand = func(_ interface{}, _ string, _ error) {
+			postCalled = true
+		}
+
+		if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("CCMD", ""); err != nil {
+			t.Error("Unexpected handleCmd error:", err)
+			t.FailNow()
+		}
+		if !strings.HasPrefix(buf.String(), "ERR") {
+			t.Error("Rejected command not failed:", buf.String())
+		}
+		if handlerCalled || postCalled {
+			t.Error("Handler or PostCommand called for rejected command")
+		}
+	})
+	t.Run("error passed to PostCommand", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+
+		var postErr error
+		proto := ProtoInfo{}
+		proto.PostCommand = func(_ interface{}, _ string, err error) {
+			postErr = err
+		}
+
+		if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("CCMD", ""); err != nil {
+			t.Error("Unexpected handleCmd error:", err)
+			t.FailNow()
+		}
+		perr, ok := postErr.(*common.Error)
+		if !ok || perr.Code != common.ErrAssUnknownCmd {
+			t.Error("Wrong error passed to PostCommand:", postErr)
+		}
+	})
+}
+
+func healthCheckTest(t *testing.T) {
+	var healthErr error
+	getinfoCalled := false
+	proto := ProtoInfo{
+		HealthCheck: func() error { return healthErr },
+		Handlers: map[string]CommandHandler{
+			"GETINFO": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				getinfoCalled = true
+				return nil, nil
+			},
+		},
+	}
+
+	check := func(params, respPrefix string) {
+		t.Helper()
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+		if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("GETINFO", params); err != nil {
+			t.Fatal("Unexpected handleCmd error:", err)
+		}
+		if !strings.HasPrefix(buf.String(), respPrefix) {
+			t.Errorf("Wrong response to GETINFO %s: %s", params, buf.String())
+		}
+	}
+
+	check("status", "OK")
+	healthErr = errors.New("database is down")
+	check("status", "ERR")
+	if getinfoCalled {
+		t.Error("GETINFO handler called for status subcommand")
+	}
+	check("version", "OK")
+	if !getinfoCalled {
+		t.Error("GETINFO handler not called for other subcommands")
+	}
+}
+
+func slowCmdTest(t *testing.T) {
+	logBuf := bytes.Buffer{}
+	Logger.SetOutput(&logBuf)
+	defer Logger.SetOutput(ioutil.Discard)
+
+	proto := ProtoInfo{
+		SlowThreshold: 10 * time.Millisecond,
+		Handlers: map[string]CommandHandler{
+			"SLOW": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				time.Sleep(20 * time.Millisecond)
+				return nil, nil
+			},
+		},
+	}
+
+	pipe := common.NewPipe(nil, ioutil.Discard)
+	if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("NOP", ""); err != nil {
+		t.Fatal("Unexpected handleCmd error:", err)
+	}
+	if strings.Contains(logBuf.String(), "slow command") {
+		t.Error("Fast command logged as slow:", logBuf.String())
+	}
+	if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("SLOW", ""); err != nil {
+		t.Fatal("Unexpected handleCmd error:", err)
+	}
+	if !strings.Contains(logBuf.String(), "slow command: SLOW took") {
+		t.Error("Slow command not logged:", logBuf.String())
+	}
+}
+
+func authTest(t *testing.T) {
+	buf := bytes.Buffer{}
+	pipe := common.NewPipe(nil, &buf)
+	called := false
+	proto := ProtoInfo{
+		Handlers: map[string]CommandHandler{
+			"CCMD": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				called = true
+				return nil, nil
+			},
+		},
+		Authenticate: func(_ interface{}, params string) *common.Error {
+			if params != "secret" {
+				return common.NewAssuanError(common.ErrBadPassphrase, "bad token")
+			}
+			return nil
+		},
+	}
+	sess := session{pipe: &pipe, proto: proto}
+
+	exec := func(cmd, params string) string {
+		buf.Reset()
+		if err := sess.handleCmd(cmd, params); err != nil {
+			t.Fatal("Unexpected handleCmd error:", err)
+		}
+		return buf.String()
+	}
+
+	if resp := exec("NOP", ""); resp != "OK\n" {
+		t.Error("NOP rejected before AUTH:", resp)
+	}
+	if resp := exec("CCMD", ""); !strings.HasPrefix(resp, "ERR "+strconv.Itoa(common.MakeErrCode(common.ErrSrcAssuan, common.ErrForbidden))) || called {
+		t.Error("Command not rejected before AUTH:", resp)
+	}
+	if resp := exec("AUTH", "wrong"); !strings.HasPrefix(resp, "ERR") {
+		t.Error("AUTH with wrong token succeeded:", resp)
+	}
+	if resp := exec("CCMD", ""); !strings.HasPrefix(resp, "ERR") || called {
+		t.Error("Command not rejected after failed AUTH:", resp)
+	}
+	if resp := exec("AUTH", "secret"); resp != "OK\n" {
+		t.Error("AUTH failed:", resp)
+	}
+	if resp := exec("CCMD", ""); resp != "OK\n" || !called {
+		t.Error("Command rejected after AUTH:", resp)
+	}
+}
+
+func echoTest(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+
+		if err := (&session{pipe: &pipe, proto: ProtoInfo{}, state: nil}).handleCmd("ECHO", "foo"); err != nil {
+			t.Fatal("Unexpected handleCmd error:", err)
+		}
+		if !strings.HasPrefix(buf.String(), "ERR") {
+			t.Error("ECHO not rejected when disabled:", buf.String())
+		}
+	})
+	t.Run("enabled", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(&buf, &buf)
+		params := "100% \\o/\r\n"
+
+		if err := (&session{pipe: &pipe, proto: ProtoInfo{EnableEcho: true}, state: nil}).handleCmd("ECHO", params); err != nil {
+			t.Fatal("Unexpected handleCmd error:", err)
+		}
+		if buf.String() != "D 100%25 \\o/%0D%0A\nOK\n" {
+			t.Fatalf("Wrong response to ECHO: %q", buf.String())
+		}
+
+		_, data, err := pipe.ReadLine()
+		if err != nil {
+			t.Fatal("Unexpected ReadLine error:", err)
+		}
+		if data != params {
+			t.Errorf("Echoed data mismatch: %q", data)
+		}
+	})
+}
+
+func auditTest(t *testing.T) {
+	auditBuf := bytes.Buffer{}
+	proto := ProtoInfo{
+		AuditWriter: &auditBuf,
+		Handlers: map[string]CommandHandler{
+			"SETPASS": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				_, perr, err := Inquire(pipe, []string{"PASSPHRASE"})
+				return perr, err
+			},
+		},
+	}
+
+	pipe := common.NewPipe(strings.NewReader("D s3cr3t-data\nEND\n"), ioutil.Discard)
+	sess := session{pipe: &pipe, proto: proto, remoteAddr: "127.0.0.1:1234"}
+	if err := sess.handleCmd("SETPASS", "s3cr3t-param"); err != nil {
+		t.Fatal("Unexpected handleCmd error:", err)
+	}
+	if err := sess.handleCmd("FOO", ""); err != nil {
+		t.Fatal("Unexpected handleCmd error:", err)
+	}
+
+	if strings.Contains(auditBuf.String(), "s3cr3t") {
+		t.Fatal("Secret data leaked into audit log:", auditBuf.String())
+	}
+
+	lines := strings.Split(strings.TrimSuffix(auditBuf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Wrong amount of audit records:", auditBuf.String())
+	}
+	var rec auditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal("Malformed audit record:", err)
+	}
+	if rec.Command != "SETPASS" || rec.ParamsLen != len("s3cr3t-param") || rec.Result != 0 || rec.RemoteAddr != "127.0.0.1:1234" {
+		t.Errorf("Wrong audit record: %+v", rec)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil {
+		t.Fatal("Malformed audit record:", err)
+	}
+	if rec.Result != common.MakeErrCode(common.ErrSrcAssuan, common.ErrAssUnknownCmd) {
+		t.Errorf("Wrong result code for unknown command: %+v", rec)
+	}
+}
+
+func utf8Test(t *testing.T) {
+	called := false
+	proto := ProtoInfo{}
+	proto.ValidateUTF8 = true
+	proto.Handlers = map[string]CommandHandler{
+		"CCMD": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+			called = true
+			return nil, nil
+		},
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+
+		if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("CCMD", "Пароль"); err != nil {
+			t.Error("Unexpected handleCmd error:", err)
+			t.FailNow()
+		}
+		if buf.String() != "OK\n" {
+			t.Error("Response to CCMD is not OK:", buf.String())
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+		called = false
+
+		if err := (&session{pipe: &pipe, proto: proto, state: nil}).handleCmd("CCMD", "\xff\xfe"); err != nil {
+			t.Error("Unexpected handleCmd error:", err)
+			t.FailNow()
+		}
+		if !strings.HasPrefix(buf.String(), "ERR") {
+			t.Error("CCMD with invalid UTF-8 not failed:", buf.String())
+		}
+		if called {
+			t.Error("Handler called for invalid UTF-8 parameters")
+		}
+	})
+}
+
+func TestServeContext(t *testing.T) {
+	proto := ProtoInfo{
+		Greeting:        "test",
+		GetDefaultState: func() interface{} { return nil },
+	}
+
+	t.Run("deadline support", func(t *testing.T) {
+		srv, cl := net.Pipe()
+		defer cl.Close()
+		defer srv.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- ServeContext(ctx, srv, proto)
+		}()
+
+		pipe := common.New(cl)
+		if _, _, err := pipe.ReadLine(); err != nil {
+			t.Fatal("Failed to read greeting:", err)
+		}
+		if err := pipe.WriteLine("NOP", ""); err != nil {
+			t.Fatal(err)
+		}
+		if cmd, _, err := pipe.ReadLine(); err != nil || cmd != "OK" {
+			t.Fatal("Unexpected response to NOP:", cmd, err)
+		}
+
+		cancel()
+		select {
+		case err := <-errCh:
+			if err != context.Canceled {
+				t.Error("Expected context.Canceled, got:", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("ServeContext didn't returned after cancellation")
+		}
+	})
+	t.Run("no deadline support", func(t *testing.T) {
+		srvR, clW := io.Pipe()
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- ServeContext(ctx, common.ReadWriter{Reader: srvR, Writer: ioutil.Discard}, proto)
+		}()
+
+		defer srvR.Close()
+
+		cancel()
+		// Command is not executed but unblocks ServeContext. Write may
+		// block forever if ServeContext returned before reading.
+		go clW.Write([]byte("NOP\n"))
+		select {
+		case err := <-errCh:
+			if err != context.Canceled {
+				t.Error("Expected context.Canceled, got:", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("ServeContext didn't returned after cancellation")
+		}
+	})
+}
+
+func TestMaxSessionDuration(t *testing.T) {
+	proto := ProtoInfo{
+		MaxSessionDuration: 100 * time.Millisecond,
+		GetDefaultState:    func() interface{} { return nil },
+		Handlers: map[string]CommandHandler{
+			"GETPASS": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				_, perr, err := Inquire(pipe, []string{"PASSPHRASE"})
+				return perr, err
+			},
+		},
+	}
+
+	serve := func(t *testing.T) (*common.Pipe, chan error, func()) {
+		srv, cl := net.Pipe()
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- Serve(srv, proto)
+			srv.Close()
+		}()
+		pipe := common.New(cl)
+		if _, _, err := pipe.ReadLine(); err != nil {
+			t.Fatal("Failed to read greeting:", err)
+		}
+		return &pipe, errCh, func() { cl.Close() }
+	}
+	waitExpired := func(t *testing.T, errCh chan error) {
+		select {
+		case err := <-errCh:
+			if err != ErrSessionExpired {
+				t.Error("Expected ErrSessionExpired, got:", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Session is not terminated")
+		}
+	}
+
+	t.Run("idle", func(t *testing.T) {
+		_, errCh, cleanup := serve(t)
+		defer cleanup()
+		waitExpired(t, errCh)
+	})
+	t.Run("mid-command", func(t *testing.T) {
+		pipe, errCh, cleanup := serve(t)
+		defer cleanup()
+
+		if err := pipe.WriteLine("GETPASS", ""); err != nil {
+			t.Fatal(err)
+		}
+		if cmd, _, err := pipe.ReadLine(); err != nil || cmd != "INQUIRE" {
+			t.Fatal("Expected INQUIRE, got:", cmd, err)
+		}
+		// Never answer inquiry.
+		cmd, params, err := pipe.ReadLine()
+		if err != nil || cmd != "ERR" || !strings.Contains(params, "session expired") {
+			t.Error("Expected ERR, got:", cmd, params, err)
+		}
+		waitExpired(t, errCh)
+	})
+}
+
+func TestCommandTimeouts(t *testing.T) {
+	proto := ProtoInfo{
+		GetDefaultState: func() interface{} { return nil },
+		Handlers: map[string]CommandHandler{
+			"GETINFO": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return nil, pipe.WriteData([]byte("info"))
+			},
+			"GETPIN": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				_, perr, err := Inquire(pipe, []string{"PIN"})
+				return perr, err
+			},
+			"SLOW": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				time.Sleep(200 * time.Millisecond)
+				return nil, nil
+			},
+		},
+		CommandTimeouts: map[string]time.Duration{
+			"GETINFO": 2 * time.Second,
+			"GETPIN":  100 * time.Millisecond,
+			"SLOW":    50 * time.Millisecond,
+		},
+	}
+
+	serve := func(t *testing.T, proto ProtoInfo) (*common.Pipe, chan error, func()) {
+		srv, cl := net.Pipe()
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- Serve(srv, proto)
+			srv.Close()
+		}()
+		pipe := common.New(cl)
+		if _, _, err := pipe.ReadLine(); err != nil {
+			t.Fatal("Failed to read greeting:", err)
+		}
+		return &pipe, errCh, func() { cl.Close() }
+	}
+	expect := func(t *testing.T, pipe *common.Pipe, cmd, params string) {
+		t.Helper()
+		rcmd, rparams, err := pipe.ReadLine()
+		if err != nil || rcmd != cmd || !strings.Contains(rparams, params) {
+			t.Fatalf("Expected %s %s, got: %s %s %v", cmd, params, rcmd, rparams, err)
+		}
+	}
+	waitErr := func(t *testing.T, errCh chan error, expected error) {
+		t.Helper()
+		select {
+		case err := <-errCh:
+			if err != expected {
+				t.Errorf("Expected %v, got: %v", expected, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Session is not terminated")
+		}
+	}
+
+	t.Run("fast command", func(t *testing.T) {
+		pipe, errCh, cleanup := serve(t, proto)
+		defer cleanup()
+
+		for i := 0; i < 2; i++ {
+			if err := pipe.WriteLine("GETINFO", ""); err != nil {
+				t.Fatal(err)
+			}
+			expect(t, pipe, "D", "info")
+			expect(t, pipe, "OK", "")
+		}
+		if err := pipe.WriteLine("BYE", ""); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, pipe, "OK", "")
+		waitErr(t, errCh, nil)
+	})
+	t.Run("interrupted inquiry", func(t *testing.T) {
+		pipe, errCh, cleanup := serve(t, proto)
+		defer cleanup()
+
+		if err := pipe.WriteLine("GETPIN", ""); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, pipe, "INQUIRE", "PIN")
+		// Never answer inquiry.
+		expect(t, pipe, "ERR", "command timed out")
+		waitErr(t, errCh, ErrCommandTimeout)
+	})
+	t.Run("slow handler", func(t *testing.T) {
+		pipe, errCh, cleanup := serve(t, proto)
+		defer cleanup()
+
+		if err := pipe.WriteLine("SLOW", ""); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, pipe, "ERR", "command timed out")
+
+		// Handler didn't read anything, so session continues.
+		if err := pipe.WriteLine("NOP", ""); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, pipe, "OK", "")
+		if err := pipe.WriteLine("BYE", ""); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, pipe, "OK", "")
+		waitErr(t, errCh, nil)
+	})
+	t.Run("overrides session duration", func(t *testing.T) {
+		proto := proto
+		proto.MaxSessionDuration = 50 * time.Millisecond
+		proto.CommandTimeouts = map[string]time.Duration{"GETPIN": 2 * time.Second}
+		pipe, errCh, cleanup := serve(t, proto)
+		defer cleanup()
+
+		if err := pipe.WriteLine("GETPIN", ""); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, pipe, "INQUIRE", "PIN")
+		time.Sleep(100 * time.Millisecond)
+		if err := pipe.WriteData([]byte("1234")); err != nil {
+			t.Fatal(err)
+		}
+		if err := pipe.WriteLine("END", ""); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, pipe, "OK", "")
+		waitErr(t, errCh, ErrSessionExpired)
+	})
+}
+
+func TestNetServer_ReloadProto(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	protoWithResp := func(resp string) ProtoInfo {
+		return ProtoInfo{
+			NopResponse:     resp,
+			GetDefaultState: func() interface{} { return nil },
+		}
+	}
+	srv := NewNetServer(protoWithResp("old"))
+	go srv.Serve(l)
+
+	connect := func() *common.Pipe {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		pipe := common.New(conn)
+		if _, _, err := pipe.ReadLine(); err != nil {
+			t.Fatal("Failed to read greeting:", err)
+		}
+		return &pipe
+	}
+	nop := func(pipe *common.Pipe) string {
+		if err := pipe.WriteLine("NOP", ""); err != nil {
+			t.Fatal(err)
+		}
+		cmd, params, err := pipe.ReadLine()
+		if err != nil || cmd != "OK" {
+			t.Fatal("Unexpected response to NOP:", cmd, err)
+		}
+		return params
+	}
+
+	oldConn := connect()
+	srv.ReloadProto(protoWithResp("new"))
+	newConn := connect()
+
+	if resp := nop(oldConn); resp != "old" {
+		t.Errorf("Existing connection uses reloaded ProtoInfo: %s", resp)
+	}
+	if resp := nop(newConn); resp != "new" {
+		t.Errorf("New connection uses old ProtoInfo: %s", resp)
+	}
+}
+
+// failingWriter fails write that contains line starting with prefix.
+type failingWriter struct {
+	prefix  string
+	written bytes.Buffer
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if bytes.HasPrefix(b, []byte(w.prefix)) || bytes.Contains(b, []byte("\n"+w.prefix)) {
+		return 0, errors.New("broken pipe")
+	}
+	return w.written.Write(b)
+}
+
+func TestServe_ResponseWriteFailure(t *testing.T) {
+	logBuf := bytes.Buffer{}
+	Logger.SetOutput(&logBuf)
+	defer Logger.SetOutput(ioutil.Discard)
+
+	proto := ProtoInfo{
+		Greeting:        "hello",
+		GetDefaultState: func() interface{} { return nil },
+		Handlers: map[string]CommandHandler{
+			"GETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return nil, pipe.WriteData([]byte("data"))
+			},
+		},
+	}
+	// Greeting has parameters, so only final OK fails.
+	w := &failingWriter{prefix: "OK\n"}
+	in := strings.NewReader("GETDATA\nNOP\n")
+
+	err := Serve(common.ReadWriter{Reader: in, Writer: w}, proto)
+	if err == nil || err.Error() != "broken pipe" {
+		t.Fatal("Expected write error, got:", err)
+	}
+	// Data is buffered and written together with OK.
+	if w.written.String() != "OK hello\n" {
+		t.Errorf("Wrong output: %q", w.written.String())
+	}
+	if !strings.Contains(logBuf.String(), "failed to send OK for GETDATA") {
+		t.Error("Failure is not logged with command name:", logBuf.String())
+	}
+}
+
+func TestServeOnce(t *testing.T) {
+	proto := ProtoInfo{
+		Greeting:        "hello",
+		GetDefaultState: func() interface{} { return nil },
+		Handlers: map[string]CommandHandler{
+			"SETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				data, perr, err := Inquire(pipe, []string{"DATA"})
+				if perr != nil || err != nil {
+					return perr, err
+				}
+				return nil, pipe.WriteData(data["DATA"])
+			},
+		},
+	}
+
+	srv, cl := net.Pipe()
+	defer cl.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ServeOnce(srv, proto)
+		srv.Close()
+	}()
+
+	pipe := common.New(cl)
+	expect := func(cmd, params string) {
+		t.Helper()
+		rcmd, rparams, err := pipe.ReadLine()
+		if err != nil {
+			t.Fatal("Unexpected ReadLine error:", err)
+		}
+		if rcmd != cmd || rparams != params {
+			t.Fatalf("Unexpected line: %s %s", rcmd, rparams)
+		}
+	}
+
+	expect("OK", "hello")
+	if err := pipe.WriteLine("SETDATA", ""); err != nil {
+		t.Fatal(err)
+	}
+	expect("INQUIRE", "DATA")
+	if err := pipe.WriteData([]byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.WriteLine("END", ""); err != nil {
+		t.Fatal(err)
+	}
+	expect("D", "payload")
+	expect("OK", "")
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Error("Unexpected ServeOnce error:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeOnce didn't returned after first command")
+	}
+}
+
+func TestServe_EOF(t *testing.T) {
+	proto := ProtoInfo{
+		GetDefaultState: func() interface{} { return nil },
+		Handlers: map[string]CommandHandler{
+			"SETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				_, perr, err := Inquire(pipe, []string{"DATA"})
+				return perr, err
+			},
+		},
+	}
+	serve := func(in string) error {
+		return Serve(common.ReadWriter{Reader: strings.NewReader(in), Writer: ioutil.Discard}, proto)
+	}
+
+	if err := serve("NOP\n"); err != nil {
+		t.Error("Unexpected error on clean EOF:", err)
+	}
+	if err := serve("NOP\nBYE\nNOP\n"); err != nil {
+		t.Error("Unexpected error after BYE:", err)
+	}
+	if err := serve("SETDATA\nD foo\n"); err != io.ErrUnexpectedEOF {
+		t.Error("Expected io.ErrUnexpectedEOF for EOF during command, got:", err)
+	}
+}
+
+func TestServe_DataResponse(t *testing.T) {
+	proto := ProtoInfo{
+		GetDefaultState: func() interface{} { return nil },
+		Handlers: map[string]CommandHandler{
+			"GETDATA": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				return nil, pipe.WriteData([]byte("payload\n"))
+			},
+		},
+	}
+
+	out := bytes.Buffer{}
+	in := strings.NewReader("GETDATA\nNOP\n")
+	if err := Serve(common.ReadWriter{Reader: in, Writer: &out}, proto); err != nil {
+		t.Fatal("Unexpected Serve error:", err)
+	}
+	// Data is followed by exactly one bare OK, no extra lines between
+	// responses.
+	if out.String() != "OK\nD payload%0A\nOK\nOK\n" {
+		t.Errorf("Wrong output: %q", out.String())
+	}
+}
+
+func TestServe_LongLine(t *testing.T) {
+	proto := ProtoInfo{
+		GetDefaultState: func() interface{} { return nil },
+		Handlers: map[string]CommandHandler{
+			"STATUS": func(pipe *common.Pipe, _ interface{}, params string) (*common.Error, error) {
+				return nil, pipe.WriteData([]byte(params))
+			},
+		},
+	}
+
+	out := bytes.Buffer{}
+	in := strings.NewReader("STATUS " + strings.Repeat("x", 2000) + "\nSTATUS ok\n")
+	if err := Serve(common.ReadWriter{Reader: in, Writer: &out}, proto); err != nil {
+		t.Fatal("Unexpected Serve error:", err)
+	}
+	expected := "OK\nERR " + strconv.Itoa(common.MakeErrCode(common.ErrSrcAssuan, common.ErrAssLineTooLong)) +
+		" line too long <assuan>\nD ok\nOK\n"
+	if out.String() != expected {
+		t.Errorf("Wrong output: %q", out.String())
+	}
+}
+
+func TestServe_ConcurrentReset(t *testing.T) {
+	proto := ProtoInfo{
+		GetDefaultState: func() interface{} { return nil },
+		Handlers: map[string]CommandHandler{
+			"FOO": func(_ *common.Pipe, _ interface{}, _ string) (*common.Error, error) { return nil, nil },
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := bytes.Buffer{}
+			in := strings.NewReader("RESET\nFOO\nRESET\n")
+			if err := Serve(common.ReadWriter{Reader: in, Writer: &buf}, proto); err != nil {
+				t.Error("Unexpected Serve error:", err)
+			}
+			if buf.String() != "OK\nOK\nOK\nOK\n" {
+				t.Errorf("Wrong output: %q", buf.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, ok := proto.Handlers["RESET"]; ok {
+		t.Error("Default RESET handler is added to shared Handlers map")
+	}
+}
+
+func TestServeStdin(t *testing.T) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inR.Close()
+	defer inW.Close()
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outR.Close()
+	defer outW.Close()
+
+	oldStdin, oldStdout := stdin, stdout
+	stdin, stdout = inR, outW
+	defer func() { stdin, stdout = oldStdin, oldStdout }()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ServeStdin(ProtoInfo{
+			Greeting:        "hello",
+			GetDefaultState: func() interface{} { return nil },
+			Handlers: map[string]CommandHandler{
+				"UPPER": func(pipe *common.Pipe, _ interface{}, params string) (*common.Error, error) {
+					return nil, pipe.WriteData([]byte(strings.ToUpper(params)))
+				},
+			},
+		})
+	}()
+
+	pipe := common.NewPipe(outR, inW)
+	expect := func(cmd, params string) {
+		t.Helper()
+		rcmd, rparams, err := pipe.ReadLine()
+		if err != nil {
+			t.Fatal("Unexpected ReadLine error:", err)
+		}
+		if rcmd != cmd || rparams != params {
+			t.Fatalf("Unexpected line: %s %s", rcmd, rparams)
+		}
+	}
+
+	expect("OK", "hello")
+	if err := pipe.WriteLine("UPPER", "round trip"); err != nil {
+		t.Fatal(err)
+	}
+	expect("D", "ROUND TRIP")
+	expect("OK", "")
+	if err := pipe.WriteLine("BYE", ""); err != nil {
+		t.Fatal(err)
+	}
+	expect("OK", "")
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Error("Unexpected ServeStdin error:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeStdin didn't returned after BYE")
+	}
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary error" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// errListener returns queued errors from Accept.
+type errListener struct {
+	errs []error
+}
+
+func (l *errListener) Accept() (net.Conn, error) {
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func TestServeNet_AcceptErrors(t *testing.T) {
+	fatal := errors.New("fatal error")
+	l := &errListener{errs: []error{tempError{}, tempError{}, fatal}}
+
+	if err := ServeNet(l, ProtoInfo{}); err != fatal {
+		t.Error("Expected non-temporary error to be returned, got:", err)
+	}
+	if len(l.errs) != 0 {
+		t.Error("Temporary errors are not retried")
+	}
+}
+
+func TestServeNet_RemoteAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("Failed to create listener:", err)
+	}
+	defer l.Close()
+
+	addrCh := make(chan net.Addr, 1)
+	go ServeNet(l, ProtoInfo{
+		GetDefaultState: func() interface{} { return nil },
+		Handlers: map[string]CommandHandler{
+			"WHOAMI": func(pipe *common.Pipe, _ interface{}, _ string) (*common.Error, error) {
+				addrCh <- pipe.RemoteAddr()
+				return nil, nil
+			},
+		},
+	})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pipe := common.New(conn)
+	if _, _, err := pipe.ReadLine(); err != nil {
+		t.Fatal("Failed to read greeting:", err)
+	}
+	if err := pipe.WriteLine("WHOAMI", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case addr := <-addrCh:
+		if addr == nil || addr.String() != conn.LocalAddr().String() {
+			t.Errorf("Wrong remote address: wanted %v, got %v", conn.LocalAddr(), addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler is not called")
+	}
+
+	stdPipe := common.NewPipe(strings.NewReader(""), ioutil.Discard)
+	if addr := stdPipe.RemoteAddr(); addr != nil {
+		t.Error("Non-nil remote address for non-network stream:", addr)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-assuan-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "S.test")
+
+	// Stale socket from dead server.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Skip("Unix sockets are not supported:", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatal("Unexpected ListenUnix error:", err)
+	}
+	defer l.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Wrong socket permissions: %v", info.Mode().Perm())
+	}
+
+	if _, err := ListenUnix(path, 0600); err == nil {
+		t.Error("Socket in use is replaced")
+	}
+
+	regular := filepath.Join(dir, "regular")
+	if err := ioutil.WriteFile(regular, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenUnix(regular, 0600); err == nil {
+		t.Error("Regular file is replaced")
+	}
 }